@@ -0,0 +1,299 @@
+package main
+
+// This provides role based access control over which users may run which
+// stacks, playbooks and actions.
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessCacheTTL is how long user IDs and group memberships are cached.
+const accessCacheTTL = 5 * time.Minute
+
+// AccessRule grants the listed users and the members of the listed groups
+// access to the stacks, playbooks and actions matching any Allow pattern.
+// Patterns are of the form stack[/playbook[/action]] where each element may
+// contain shell wildcards and missing elements match anything.
+type AccessRule struct {
+	Users  []string `yaml:"users,omitempty"`  // User IDs or names.
+	Groups []string `yaml:"groups,omitempty"` // User group IDs or names.
+	Allow  []string `yaml:"allow"`
+}
+
+// Identity describes a user for the purpose of access control.
+type Identity struct {
+	ID     string
+	Name   string
+	Users  map[string]bool // The user names referenced by the rules that are the user's.
+	Groups map[string]bool // The groups referenced by the rules that the user is in.
+}
+
+type cachedMembers struct {
+	members map[string]bool
+	expires time.Time
+}
+
+type cachedID struct {
+	id      string
+	expires time.Time
+}
+
+// Access checks requests against a set of AccessRules.  If there are no rules
+// everyone may run everything.
+type Access struct {
+	sync.Mutex
+	rules   []AccessRule
+	chat    Chat
+	ids     map[string]cachedID // Keyed by user name.
+	members map[string]cachedMembers
+}
+
+func NewAccess(chat Chat, rules []AccessRule) *Access {
+	return &Access{
+		rules:   rules,
+		chat:    chat,
+		ids:     make(map[string]cachedID),
+		members: make(map[string]cachedMembers),
+	}
+}
+
+// SetRules replaces the access rules.
+func (a *Access) SetRules(rules []AccessRule) {
+	a.Lock()
+	defer a.Unlock()
+	a.rules = rules
+	a.ids = make(map[string]cachedID) // The users and groups may have changed.
+	a.members = make(map[string]cachedMembers)
+}
+
+// Restricted returns whether any access rules are in force.
+func (a *Access) Restricted() bool {
+	a.Lock()
+	defer a.Unlock()
+	return len(a.rules) > 0
+}
+
+// Identify looks up which of the users and groups named by the rules are the
+// user identified by id.  Rules are matched on user IDs, as users can change
+// their names.
+func (a *Access) Identify(id string) (who *Identity, err error) {
+	who = &Identity{ID: id, Users: make(map[string]bool), Groups: make(map[string]bool)}
+
+	// Look users and groups up without holding the lock, as that needs the
+	// chat server.
+	a.Lock()
+	rules := a.rules
+	a.Unlock()
+
+	for _, rule := range rules {
+		for _, user := range rule.Users {
+			var ok bool
+			if ok, err = a.isUser(id, user); err != nil {
+				return nil, err
+			} else if ok {
+				who.Users[user] = true
+			}
+		}
+		for _, group := range rule.Groups {
+			var members map[string]bool
+			if members, err = a.groupMembers(group); err != nil {
+				return nil, fmt.Errorf("I couldn't look up the members of the %s group: %s", group, err)
+			}
+			if members[id] {
+				who.Groups[group] = true
+			}
+		}
+	}
+
+	return
+}
+
+// isUser returns whether user, a user ID or name from a rule, is the user
+// identified by id.
+func (a *Access) isUser(id, user string) (bool, error) {
+	if user == "*" || user == id {
+		return true, nil
+	}
+	userID, err := a.userID(user)
+	if err != nil {
+		return false, fmt.Errorf("I couldn't look up the user %s: %s", user, err)
+	}
+	return userID == id, nil
+}
+
+// userID returns the cached ID of the user called name, or an empty string if
+// there's no such user.
+func (a *Access) userID(name string) (id string, err error) {
+	a.Lock()
+	cached, ok := a.ids[name]
+	a.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.id, nil
+	}
+
+	if id, err = a.chat.UserID(name); err != nil {
+		return
+	}
+	a.Lock()
+	a.ids[name] = cachedID{id, time.Now().Add(accessCacheTTL)}
+	a.Unlock()
+	return
+}
+
+// groupMembers returns the cached members of a group.
+func (a *Access) groupMembers(group string) (map[string]bool, error) {
+	a.Lock()
+	cached, ok := a.members[group]
+	a.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.members, nil
+	}
+
+	ids, err := a.chat.GroupMembers(group)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make(map[string]bool)
+	for _, id := range ids {
+		members[id] = true
+	}
+	a.Lock()
+	a.members[group] = cachedMembers{members, time.Now().Add(accessCacheTTL)}
+	a.Unlock()
+	return members, nil
+}
+
+// InGroup returns whether the user identified by id is a member of group.
+func (a *Access) InGroup(id, group string) (bool, error) {
+	members, err := a.groupMembers(group)
+	if err != nil {
+		return false, err
+	}
+	return members[id], nil
+}
+
+// Allows returns whether who may run action on the playbook from stack.
+func (a *Access) Allows(who *Identity, stack, playbook, action string) bool {
+	a.Lock()
+	defer a.Unlock()
+	if len(a.rules) == 0 {
+		return true
+	}
+
+	for _, rule := range a.rules {
+		if !rule.applies(who) {
+			continue
+		}
+		for _, pattern := range rule.Allow {
+			if accessMatch(pattern, stack, playbook, action) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Grants returns whether any of rules, which are separate from the access
+// rules, grants the user identified by id access to action on the playbook
+// from stack.  No rules grant nothing.
+func (a *Access) Grants(id string, rules []AccessRule, stack, playbook, action string) (bool, error) {
+	for _, rule := range rules {
+		matched := false
+		for _, pattern := range rule.Allow {
+			if accessMatch(pattern, stack, playbook, action) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		for _, user := range rule.Users {
+			if ok, err := a.isUser(id, user); err != nil {
+				return false, err
+			} else if ok {
+				return true, nil
+			}
+		}
+		for _, group := range rule.Groups {
+			members, err := a.groupMembers(group)
+			if err != nil {
+				return false, fmt.Errorf("I couldn't look up the members of the %s group: %s", group, err)
+			} else if members[id] {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// Stacks returns an ordered list of the stacks in config from which who may
+// run something.
+func (a *Access) Stacks(who *Identity, config *Config) (stacks []string) {
+	for _, stack := range config.GetStackList() {
+		if len(a.Playbooks(who, stack, config.Stacks()[stack])) > 0 {
+			stacks = append(stacks, stack)
+		}
+	}
+	return
+}
+
+// Playbooks returns an ordered list of the playbooks in st that who may run,
+// or run an action from.
+func (a *Access) Playbooks(who *Identity, stack string, st Stack) (playbooks []string) {
+	for _, playbook := range st.GetPlaybookList() {
+		pb := st.Playbooks[playbook]
+		if a.Allows(who, stack, playbook, "run") || len(a.Actions(who, stack, playbook, pb)) > 0 {
+			playbooks = append(playbooks, playbook)
+		}
+	}
+	return
+}
+
+// Actions returns an ordered list of the additional actions in pb that who may
+// run.
+func (a *Access) Actions(who *Identity, stack, playbook string, pb Playbook) (actions []string) {
+	for _, action := range pb.GetActionList() {
+		if a.Allows(who, stack, playbook, action) {
+			actions = append(actions, action)
+		}
+	}
+	return
+}
+
+// applies returns whether the rule applies to who.
+func (r AccessRule) applies(who *Identity) bool {
+	for _, user := range r.Users {
+		if user == "*" || user == who.ID || who.Users[user] {
+			return true
+		}
+	}
+	for _, group := range r.Groups {
+		if who.Groups[group] {
+			return true
+		}
+	}
+	return false
+}
+
+// accessMatch returns whether pattern matches the stack, playbook and action.
+func accessMatch(pattern, stack, playbook, action string) bool {
+	parts := strings.SplitN(pattern, "/", 3)
+	for i, name := range []string{stack, playbook, action} {
+		if i >= len(parts) {
+			break
+		}
+		if ok, err := path.Match(parts[i], name); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// fakeAccessChat looks up the users and groups Access needs.  It panics if
+// anything else is used.
+type fakeAccessChat struct {
+	Chat
+	users  map[string]string   // IDs keyed by user name.
+	groups map[string][]string // Member IDs keyed by group.
+}
+
+func (c *fakeAccessChat) UserID(name string) (string, error) {
+	return c.users[name], nil
+}
+
+func (c *fakeAccessChat) GroupMembers(group string) ([]string, error) {
+	members, ok := c.groups[group]
+	if !ok {
+		return nil, fmt.Errorf("there's no user group called %s", group)
+	}
+	return members, nil
+}
+
+func newFakeAccessChat() *fakeAccessChat {
+	return &fakeAccessChat{
+		users:  map[string]string{"alice": "U1", "bob": "U2", "carol": "U3"},
+		groups: map[string][]string{"ops": {"U3", "U4"}, "empty": nil},
+	}
+}
+
+func TestAccessAllows(t *testing.T) {
+	rules := []AccessRule{
+		{Users: []string{"*"}, Allow: []string{"*/*/status"}},
+		{Users: []string{"alice", "dave"}, Allow: []string{"website"}},
+		{Users: []string{"U2"}, Allow: []string{"website/staging", "reports/nightly/run"}},
+		{Groups: []string{"ops"}, Allow: []string{"*/production/deploy"}},
+	}
+	access := NewAccess(newFakeAccessChat(), rules)
+
+	tests := []struct {
+		id                      string
+		stack, playbook, action string
+		allowed                 bool
+	}{
+		{"U1", "website", "production", "run", true},    // By name.
+		{"U1", "website", "staging", "restart", true},   // A missing part matches anything.
+		{"U1", "reports", "nightly", "run", false},      // Not listed.
+		{"U2", "website", "staging", "run", true},       // By ID.
+		{"U2", "website", "production", "run", false},   // Another playbook.
+		{"U2", "reports", "nightly", "run", true},       // An exact action.
+		{"U2", "reports", "nightly", "rebuild", false},  // Another action.
+		{"U3", "website", "production", "deploy", true}, // By group, with a wildcard.
+		{"U3", "website", "production", "run", false},   // Another action.
+		{"U4", "api", "production", "deploy", true},     // Another member of the group.
+		{"U5", "website", "production", "status", true}, // Everyone.
+		{"U5", "website", "production", "run", false},   // No rule applies.
+		{"U6", "website", "production", "run", false},   // dave doesn't exist.
+	}
+
+	for _, test := range tests {
+		who, err := access.Identify(test.id)
+		if err != nil {
+			t.Fatalf("couldn't identify %s: %s", test.id, err)
+		}
+		if allowed := access.Allows(who, test.stack, test.playbook, test.action); allowed != test.allowed {
+			t.Errorf("%s %s/%s/%s: expected %t, got %t", test.id, test.stack, test.playbook, test.action, test.allowed, allowed)
+		}
+	}
+}
+
+func TestAccessUnrestricted(t *testing.T) {
+	access := NewAccess(nil, nil)
+	who, err := access.Identify("U1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if access.Restricted() || !access.Allows(who, "website", "production", "run") {
+		t.Error("everything should be allowed without any rules")
+	}
+}
+
+func TestAccessIdentifyErrors(t *testing.T) {
+	access := NewAccess(newFakeAccessChat(), []AccessRule{{Groups: []string{"missing"}, Allow: []string{"*"}}})
+	if _, err := access.Identify("U1"); err == nil {
+		t.Error("expected an error for a group that can't be looked up")
+	}
+}
+
+func TestAccessGrants(t *testing.T) {
+	access := NewAccess(newFakeAccessChat(), nil)
+	overriders := []AccessRule{
+		{Users: []string{"alice"}, Allow: []string{"website/production"}},
+		{Groups: []string{"ops"}, Allow: []string{"*"}},
+		{Users: []string{"U2"}, Allow: []string{"reports/*/run"}},
+	}
+
+	tests := []struct {
+		id                      string
+		rules                   []AccessRule
+		stack, playbook, action string
+		granted                 bool
+	}{
+		{"U1", overriders, "website", "production", "run", true},
+		{"U1", overriders, "website", "staging", "run", false},
+		{"U2", overriders, "reports", "nightly", "run", true},
+		{"U2", overriders, "reports", "nightly", "rebuild", false},
+		{"U3", overriders, "anything", "at", "all", true},
+		{"U5", overriders, "website", "production", "run", false},
+		{"U1", nil, "website", "production", "run", false}, // No rules grant nothing.
+		{"U1", []AccessRule{{Users: []string{"*"}, Allow: []string{"*"}}}, "website", "production", "run", true},
+	}
+
+	for _, test := range tests {
+		granted, err := access.Grants(test.id, test.rules, test.stack, test.playbook, test.action)
+		if err != nil {
+			t.Errorf("%s %s/%s/%s: unexpected error: %s", test.id, test.stack, test.playbook, test.action, err)
+		} else if granted != test.granted {
+			t.Errorf("%s %s/%s/%s: expected %t, got %t", test.id, test.stack, test.playbook, test.action, test.granted, granted)
+		}
+	}
+
+	if _, err := access.Grants("U1", []AccessRule{{Groups: []string{"missing"}, Allow: []string{"*"}}}, "website", "production", "run"); err == nil {
+		t.Error("expected an error for a group that can't be looked up")
+	}
+}
+
+func TestAccessMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		matches bool
+	}{
+		{"*", true},
+		{"website", true},
+		{"web*", true},
+		{"website/production", true},
+		{"website/prod*/run", true},
+		{"website/production/deploy", false},
+		{"website/staging", false},
+		{"api", false},
+		{"[", false}, // Invalid patterns match nothing.
+	}
+	for _, test := range tests {
+		if matches := accessMatch(test.pattern, "website", "production", "run"); matches != test.matches {
+			t.Errorf("%s: expected %t, got %t", test.pattern, test.matches, matches)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+// This provides an HTTP API for listing, running and cancelling playbooks
+// without going through chat.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const apiPrefix = "/api/v1"
+
+// apiServer handles API requests.  Callers authenticate with a bearer token
+// and are identified to the access rules as api:<token name>.
+type apiServer struct {
+	chat   Chat
+	state  *RunState
+	config *Config
+	logger *log.Logger
+}
+
+// apiHandler is an http.HandlerFunc for an authenticated caller.
+type apiHandler func(w http.ResponseWriter, r *http.Request, who *Identity)
+
+// ServeAPI serves the API on the address given in config.
+func ServeAPI(chat Chat, state *RunState, config *Config, logger *log.Logger) {
+	s := &apiServer{chat, state, config, logger}
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"/stacks", s.auth(s.handleStacks))
+	mux.HandleFunc(apiPrefix+"/runs", s.auth(s.handleRuns))
+	mux.HandleFunc(apiPrefix+"/runs/", s.auth(s.handleRun))
+	if i, ok := chat.(Interactive); ok && config.SlackSecret != "" {
+		mux.Handle("/slack/interactions", i.Interactions(config.SlackSecret))
+	}
+	if config.WebhookSecret != "" {
+		mux.Handle(registryWebhookPath, &registryWebhook{chat, config, logger})
+	}
+
+	logger.Printf("serving the API on %s", config.APIListen)
+	if err := http.ListenAndServe(config.APIListen, mux); err != nil {
+		logger.Printf("the API server failed: %s", err)
+	}
+}
+
+// auth checks the bearer token of a request before passing it on to h.
+func (s *apiServer) auth(h apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "" {
+			for name, secret := range s.config.Current().API.Tokens {
+				if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+					id := "api:" + name
+					h(w, r, &Identity{ID: id, Name: id, Groups: make(map[string]bool)})
+					return
+				}
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		apiError(w, http.StatusUnauthorized, errors.New("a valid bearer token is required"))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+type apiPlaybook struct {
+	About   string           `json:"about,omitempty"`
+	Actions []string         `json:"actions,omitempty"`
+	Params  map[string]Param `json:"params,omitempty"`
+}
+
+// handleStacks lists the stacks and playbooks the caller may run.
+func (s *apiServer) handleStacks(w http.ResponseWriter, r *http.Request, who *Identity) {
+	if r.Method != "GET" {
+		apiError(w, http.StatusMethodNotAllowed, errors.New("use GET"))
+		return
+	}
+
+	stacks := make(map[string]map[string]*apiPlaybook)
+	for _, stack := range s.config.Access.Stacks(who, s.config) {
+		st := s.config.Stacks()[stack]
+		playbooks := make(map[string]*apiPlaybook)
+		for _, name := range s.config.Access.Playbooks(who, stack, st) {
+			pb := st.Playbooks[name]
+			playbooks[name] = &apiPlaybook{
+				About:   pb.About,
+				Actions: s.config.Access.Actions(who, stack, name, pb),
+				Params:  pb.Params,
+			}
+		}
+		stacks[stack] = playbooks
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"stacks": stacks})
+}
+
+// apiRunRequest is the body of a request to start a run.
+type apiRunRequest struct {
+	Stack    string            `json:"stack"`
+	Playbook string            `json:"playbook"`
+	Action   string            `json:"action"` // Defaults to run.
+	Params   map[string]string `json:"params"`
+	Limit    string            `json:"limit"`
+	Tags     string            `json:"tags"`
+	SkipTags string            `json:"skip_tags"`
+	Plan     bool              `json:"plan"`    // Whether to do a dry run in check mode.
+	Confirm  bool              `json:"confirm"` // Confirms a run affecting production.
+
+	OverrideFreeze string `json:"override_freeze"` // Why the run should go ahead despite a freeze.
+}
+
+// apiRunStatus describes a run.
+type apiRunStatus struct {
+	ID       string     `json:"id"`
+	Status   string     `json:"status"` // One of pending, queued, running or finished.
+	Position int        `json:"position,omitempty"`
+	Outcome  string     `json:"outcome,omitempty"` // How a finished run ended.
+	Record   *RunRecord `json:"record,omitempty"`
+}
+
+// handleRuns starts a run.
+func (s *apiServer) handleRuns(w http.ResponseWriter, r *http.Request, who *Identity) {
+	if r.Method != "POST" {
+		apiError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+
+	var req apiRunRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, fmt.Errorf("the request body isn't valid JSON: %s", err))
+		return
+	}
+	if req.Action == "" {
+		req.Action = "run"
+	}
+
+	settings := s.config.Current()
+	channel := settings.API.Channel
+	if channel == "" {
+		channel = settings.Notifications.Runs
+	}
+	if channel == "" {
+		apiError(w, http.StatusServiceUnavailable, errors.New("no channel is configured for announcing API runs"))
+		return
+	}
+
+	executors, err := NewExecutors(s.config)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, fmt.Errorf("I could not create the playbook executor: %s", err))
+		return
+	}
+
+	opts := &RunOptions{Limit: req.Limit, Tags: req.Tags, SkipTags: req.SkipTags, OverrideFreeze: req.OverrideFreeze}
+	run, args, pb, err := prepareRun(who, req.Action, req.Stack, req.Playbook, opts, req.Params, req.Plan, s.config)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// There's no one to ask, so production runs must be confirmed up front.
+	if pb.NeedsConfirmation(req.Action) && !req.Plan && !req.Confirm {
+		run.cancel()
+		apiError(w, http.StatusConflict, fmt.Errorf("*%s %s* affects production: set confirm to true to run it", req.Stack, req.Playbook))
+		return
+	}
+	executor, err := executors.For(req.Stack, s.config)
+	if err != nil {
+		run.cancel()
+		apiError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Announce the run, using the announcement as the thread for its
+	// progress.
+	text := fmt.Sprintf("`%s` asked me via the API to ", who.Name)
+	if req.Plan {
+		text += "plan"
+	} else {
+		text += "run"
+	}
+	text += fmt.Sprintf(" *%s %s*", req.Stack, req.Playbook)
+	if req.Action != "run" {
+		text += fmt.Sprintf(" (%s)", req.Action)
+	}
+	text += fmt.Sprintf(" as `%s`.", run.ID)
+	thread, err := s.chat.PostThread(channel, "", text)
+	if err != nil {
+		run.cancel()
+		apiError(w, http.StatusBadGateway, fmt.Errorf("I couldn't announce the run: %s", err))
+		return
+	}
+	msg := NewThreadMessage(s.chat, channel, thread, who.ID, fmt.Sprintf("`%s`", who.Name))
+
+	if run.Options.OverrideFreeze != "" {
+		logFreezeOverride(s.logger, who, run)
+	}
+	startRun(msg, run, args, pb, executor, s.state, s.config)
+	_, status, position := s.state.Status(run.ID)
+	writeJSON(w, http.StatusAccepted, &apiRunStatus{ID: run.ID, Status: status, Position: position})
+}
+
+// handleRun reports on or cancels the run identified in the path.
+func (s *apiServer) handleRun(w http.ResponseWriter, r *http.Request, who *Identity) {
+	id := strings.TrimPrefix(r.URL.Path, apiPrefix+"/runs/")
+
+	switch r.Method {
+	case "GET":
+		if run, status, position := s.state.Status(id); status != "" {
+			if !s.config.Access.Allows(who, run.Stack, run.Playbook, run.Action) {
+				apiError(w, http.StatusForbidden, errors.New("you're not allowed to run that playbook"))
+				return
+			}
+			writeJSON(w, http.StatusOK, &apiRunStatus{ID: id, Status: status, Position: position})
+			return
+		}
+
+		rec, err := s.state.History.Get(id)
+		if err == errRunNotFound {
+			apiError(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			apiError(w, http.StatusInternalServerError, err)
+			return
+		}
+		// The record includes the output, which only those who may run the
+		// playbook should see.
+		if !s.config.Access.Allows(who, rec.Stack, rec.Playbook, rec.Action) {
+			apiError(w, http.StatusForbidden, errors.New("you're not allowed to run that playbook"))
+			return
+		}
+		writeJSON(w, http.StatusOK, &apiRunStatus{ID: id, Status: "finished", Outcome: rec.Outcome(), Record: rec})
+
+	case "DELETE":
+		run, status, _ := s.state.Status(id)
+		if run == nil {
+			apiError(w, http.StatusNotFound, errors.New("there's no pending, queued or running run with that ID"))
+			return
+		}
+		if !s.config.Access.Allows(who, run.Stack, run.Playbook, run.Action) {
+			apiError(w, http.StatusForbidden, errors.New("you're not allowed to run that playbook"))
+			return
+		}
+
+		var err error
+		switch status {
+		case "pending":
+			_, err = s.state.Unpark(id)
+		case "queued":
+			_, err = s.state.DequeueIf(id, func(queued *Run) error {
+				if !s.config.Access.Allows(who, queued.Stack, queued.Playbook, queued.Action) {
+					return errors.New("you're not allowed to run that playbook")
+				}
+				return nil
+			})
+		case "running":
+			if !run.Stop(fmt.Sprintf("cancelled by `%s`", who.Name)) {
+				err = errors.New("the run is already stopping")
+			}
+		}
+		if err != nil {
+			apiError(w, http.StatusConflict, err)
+			return
+		}
+		if status != "running" {
+			s.chat.Post(run.Channel, fmt.Sprintf("`%s` has dropped `%s` (*%s %s* for %s) via the API.", who.Name, run.ID, run.Stack, run.Playbook, run.Requester))
+		}
+		writeJSON(w, http.StatusOK, &apiRunStatus{ID: id, Status: "cancelled"})
+
+	default:
+		apiError(w, http.StatusMethodNotAllowed, errors.New("use GET or DELETE"))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+// This provides the abstraction over the chat platform Lurch is connected to.
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// MaxMessageLength is the longest message that can be posted to any of the
+// supported chat platforms.
+const MaxMessageLength = 4000
+
+// Chat is implemented by each chat platform Lurch can talk over.
+type Chat interface {
+	// Connect establishes and maintains the connection to the chat platform,
+	// sending events to the Events channel.
+	Connect()
+
+	// Events returns the channel on which chat events are delivered. These are
+	// one of the *Chat*Event types defined below.
+	Events() <-chan interface{}
+
+	// Post sends text to the channel identified by id.
+	Post(id, text string) error
+
+	// PostThread sends text to the thread rooted at the message thread in the
+	// channel id, returning the ID of the new message.
+	PostThread(id, thread, text string) (string, error)
+
+	// Update replaces the text of the message msgID in the channel id.
+	Update(id, msgID, text string) error
+
+	// Upload attaches content as a file called filename to the thread rooted
+	// at the message thread in the channel id.
+	Upload(id, thread, filename, title string, content []byte) error
+
+	// PostButtons sends text with buttons to the thread rooted at the message
+	// thread in the channel id, or to the channel if thread is empty,
+	// returning the ID of the new message.  Platforms without buttons list
+	// the commands instead.
+	PostButtons(id, thread, text string, buttons []Button) (string, error)
+
+	// Channels returns the channels and groups of which Lurch is a member.
+	Channels() (*Channels, error)
+
+	// UserID returns the ID of the user called name, or an empty string if
+	// there isn't one.
+	UserID(name string) (string, error)
+
+	// GroupMembers returns the IDs of the users in the user group identified
+	// by its ID or name.
+	GroupMembers(group string) ([]string, error)
+}
+
+// Interactive is implemented by chat platforms that report button presses to
+// Lurch over HTTP.
+type Interactive interface {
+	// Interactions returns the handler for button presses, which checks
+	// their authenticity using secret.  Presses are sent to the Events
+	// channel as ChatCommandEvents.
+	Interactions(secret string) http.Handler
+}
+
+// Button is a button on a message which, when pressed, issues Command to Lurch
+// on behalf of the user pressing it.
+type Button struct {
+	Text    string
+	Command string
+	Style   string // One of primary, danger or empty for the default.
+	Once    bool   // Whether to remove the buttons from the message once this is pressed.
+}
+
+// ButtonCommands appends the commands issued by buttons to text, for when
+// buttons can't be used.  Commands already in text aren't repeated.
+func ButtonCommands(text string, buttons []Button) string {
+	var commands []string
+	for _, button := range buttons {
+		if !strings.Contains(text, button.Command) {
+			commands = append(commands, fmt.Sprintf("*`%s`*", button.Command))
+		}
+	}
+	if len(commands) > 0 {
+		text += fmt.Sprintf("\n_Reply %s._", strings.Join(commands, " or "))
+	}
+	return text
+}
+
+// ChatConnectedEvent is sent whenever a connection is (re)established.
+type ChatConnectedEvent struct {
+	User *User // The identity Lurch is connected as.
+}
+
+// ChatDisconnectedEvent is sent whenever the connection is dropped.
+type ChatDisconnectedEvent struct {
+	Intentional bool
+}
+
+// ChatMessageEvent is sent for every message Lurch sees.
+type ChatMessageEvent struct {
+	Channel     string // The channel ID the message was posted to.
+	User        string // The ID of the user posting the message.
+	UserMention string // The string used to mention the posting user.
+	Text        string
+	Thread      string // The ID of the thread root, which may be the message itself.
+	Direct      bool   // Whether the message is part of a direct conversation.
+}
+
+// ChatCommandEvent is sent when a user issues a command other than by
+// messaging Lurch, such as by pressing a button.
+type ChatCommandEvent struct {
+	ChatMessageEvent
+}
+
+// ChatJoinedEvent is sent when Lurch joins a channel or group.
+type ChatJoinedEvent struct {
+	Channel string
+	Type    ChannelType
+}
+
+// ChatLeftEvent is sent when Lurch leaves a channel or group.
+type ChatLeftEvent struct {
+	Channel string
+}
+
+// ChatErrorEvent reports a non-fatal error from the chat platform.
+type ChatErrorEvent struct {
+	Err error
+}
+
+// ChatInvalidAuthEvent is sent when the chat platform rejects Lurch's
+// credentials.
+type ChatInvalidAuthEvent struct{}
+
+// NewChat returns the Chat implementation selected by config.
+func NewChat(config *Config, logger *log.Logger) (Chat, error) {
+	switch config.Chat {
+	case "slack":
+		// Buttons need somewhere to report presses to.
+		buttons := config.SlackSecret != "" && config.APIListen != ""
+		return NewSlackChat(config.SlackToken, buttons, config.Debug, logger), nil
+	case "mattermost":
+		return NewMattermostChat(config.Mattermost.URL, config.Mattermost.Token, logger)
+	default:
+		return nil, fmt.Errorf("unknown chat platform: %s", config.Chat)
+	}
+}
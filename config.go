@@ -1,29 +1,163 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
 
 type Config struct {
 	sync.RWMutex
+	Settings
 
-	Channels     *Channels // Channels of which Lurch is a member.
-	BotName      string
-	EnableDM     bool
-	SlackToken   string
-	Docker       dockerConfig
-	DisablePull  bool
-	Debug        bool
-	ConnAttempts int
-	Stacks       map[string]Stack
+	Channels      *Channels // Channels of which Lurch is a member.
+	BotName       string
+	Chat          string // The chat platform to connect to.
+	SlackToken    string
+	SlackSecret   string // The signing secret used to verify Slack button presses.
+	WebhookSecret string // The secret registries present to the webhook.
+	Mattermost    mattermostConfig
+	DockerHost    dockerHostConfig // The docker daemon to use.
+	DockerClient  *docker.Client   // Shared by the docker executors.
+	HistoryPath   string           // Where the run history is stored.
+	File          string           // Lurch's own configuration file.
+	APIListen     string           // The address to serve the API on, if any.
+	MetricsListen string           // The address to serve metrics on, if any.
+	Access        *Access          // Who may run what.
+	Freezes       *Freezes         // Freezes made from chat.
+	Digests       *ImageDigests    // The digests of the devops images.
+	updating      sync.Mutex       // Held while updating the images and reading their stacks.
+	flags         Settings         // The settings given on the command line.
+	Debug         bool
+	ConnAttempts  int
+	stacks        map[string]Stack // Read from the devops images.
+}
+
+// Settings are the parts of Config that can be changed while Lurch is running
+// by reloading the configuration file.
+type Settings struct {
+	EnableDM        bool
+	Executor        string                  // How playbooks are run.
+	Docker          dockerConfig            // The devops image given on the command line.
+	Images          map[string]dockerConfig // Named devops images, used instead of Docker if given.
+	Local           localConfig
+	DisablePull     bool
+	PollInterval    time.Duration // How often to check for newer images.
+	RunTimeout      time.Duration // The default time a playbook may run for.
+	UploadOutput    string        // When to attach the output of runs: failed, always or never.
+	ApprovalTimeout time.Duration // How long a run may wait for approval.
+	CommandChannels []string      // The only channels accepting commands, if set.
+	Notifications   notificationsConfig
+	AccessRules     []AccessRule
+	API             apiConfig
+	Freeze          freezeConfig
+	Containers      []ContainerConfig // Settings for the containers of runs.
+}
+
+// Validate returns an error if the settings can't be used.
+func (s *Settings) Validate() error {
+	switch s.Executor {
+	case "docker":
+		if len(s.Images) == 0 && s.Docker.Image == "" {
+			return errors.New("no docker image is provided")
+		}
+		for name, image := range s.Images {
+			if image.Image == "" {
+				return fmt.Errorf("no docker image is provided for %s", name)
+			}
+			switch image.Pull {
+			case "", "always", "missing", "never":
+			default:
+				return fmt.Errorf("the pull policy for the %s image must be always, missing or never, not %s", name, image.Pull)
+			}
+		}
+	case "local":
+	default:
+		return fmt.Errorf("unknown executor: %s", s.Executor)
+	}
+
+	if s.PollInterval < 0 {
+		return errors.New("poll-interval can't be negative")
+	}
+
+	switch s.UploadOutput {
+	case "failed", "always", "never":
+	default:
+		return fmt.Errorf("upload-output must be failed, always or never, not %s", s.UploadOutput)
+	}
+
+	for _, w := range s.Freeze.Windows {
+		if err := w.check(); err != nil {
+			return fmt.Errorf("invalid freeze: %s", err)
+		}
+	}
+	for _, c := range s.Containers {
+		if err := c.check(); err != nil {
+			return fmt.Errorf("invalid container settings: %s", err)
+		}
+	}
+	return nil
+}
+
+// Current returns a copy of the settings, which reloading the configuration
+// file may replace at any time.  Use it rather than reading the settings from
+// Config directly anywhere but at startup.
+func (c *Config) Current() Settings {
+	c.RLock()
+	defer c.RUnlock()
+	return c.Settings
+}
+
+// Stacks returns the stacks read from the devops images, which are replaced
+// whenever the images are updated.
+func (c *Config) Stacks() map[string]Stack {
+	c.RLock()
+	defer c.RUnlock()
+	return c.stacks
+}
+
+// SetStacks replaces the stacks.  The map mustn't be changed afterwards.
+func (c *Config) SetStacks(stacks map[string]Stack) {
+	c.Lock()
+	defer c.Unlock()
+	c.stacks = stacks
+}
+
+// DockerImages returns the devops images keyed by name.  The image given on
+// the command line is called default, and is only used if no images are named
+// in the configuration file.
+func (s *Settings) DockerImages() map[string]dockerConfig {
+	if len(s.Images) > 0 {
+		return s.Images
+	}
+	return map[string]dockerConfig{"default": s.Docker}
+}
+
+// AcceptsCommands returns whether commands that act on playbooks may be given
+// in the channel id.
+func (c *Config) AcceptsCommands(id string) bool {
+	settings := c.Current()
+	if !c.Channels.HasChannel(id) {
+		return settings.EnableDM
+	} else if len(settings.CommandChannels) == 0 {
+		return true
+	}
+
+	for _, channel := range settings.CommandChannels {
+		if channel == id {
+			return true
+		}
+	}
+	return false
 }
 
 // GetStackList returns an ordered list of stack names.
 func (c *Config) GetStackList() (stacks []string) {
-	for stack := range c.Stacks {
+	for stack := range c.Stacks() {
 		stacks = append(stacks, stack)
 	}
 	sort.Strings(stacks)
@@ -84,6 +218,7 @@ func (c *Channels) GetChannels() (chans []string) {
 
 type Stack struct {
 	Playbooks map[string]Playbook `yaml:",inline"`
+	Image     string              `yaml:"-"` // The name of the image the stack comes from.
 }
 
 // GetPlaybookList returns an ordered list of playbook names.
@@ -96,9 +231,18 @@ func (s Stack) GetPlaybookList() (playbooks []string) {
 }
 
 type Playbook struct {
-	Location string            `yaml:"playbook"`
-	About    string            `yaml:"about"`
-	Actions  map[string]Action `yaml:"actions,omitempty"`
+	Location   string            `yaml:"playbook"`
+	About      string            `yaml:"about"`
+	Timeout    time.Duration     `yaml:"timeout,omitempty"` // How long the playbook may run for.
+	Actions    map[string]Action `yaml:"actions,omitempty"`
+	Limit      []string          `yaml:"limit,omitempty"` // Host patterns allowed with --limit.
+	Tags       []string          `yaml:"tags,omitempty"`  // Tags allowed with --tags and --skip-tags.
+	Params     map[string]Param  `yaml:"params,omitempty"`
+	Schedule   *Schedule         `yaml:"schedule,omitempty"`   // When to run the playbook automatically.
+	Production bool              `yaml:"production,omitempty"` // Whether runs must be confirmed.
+
+	RequiresApproval bool   `yaml:"requires_approval,omitempty"`
+	Approvers        string `yaml:"approvers,omitempty"` // The group that may approve runs, if not anyone.
 }
 
 // GetActionList returns an ordered list of action names.
@@ -110,13 +254,91 @@ func (p Playbook) GetActionList() (actions []string) {
 	return
 }
 
+// ParamsFor returns the params declared for action, including those declared
+// for the playbook as a whole.
+func (p Playbook) ParamsFor(action string) map[string]Param {
+	params := make(map[string]Param)
+	for name, param := range p.Params {
+		params[name] = param
+	}
+	for name, param := range p.Actions[action].Params {
+		params[name] = param
+	}
+	return params
+}
+
+// Approval returns whether running action requires approval and, if so, the
+// group that may approve it, which is empty if anyone may.  Settings on an
+// action override those on the playbook.
+func (p Playbook) Approval(action string) (required bool, approvers string) {
+	required, approvers = p.RequiresApproval, p.Approvers
+	if a, ok := p.Actions[action]; ok && (a.RequiresApproval || a.Approvers != "") {
+		required = true
+		if a.Approvers != "" {
+			approvers = a.Approvers
+		}
+	}
+	return
+}
+
+// NeedsConfirmation returns whether running action affects production, so
+// the requester must confirm it before it's run.
+func (p Playbook) NeedsConfirmation(action string) bool {
+	return p.Production || p.Actions[action].Production
+}
+
 type Action struct {
-	About string            `yaml:"about"`
-	Vars  map[string]string `yaml:"vars,omitempty"`
+	About      string            `yaml:"about"`
+	Vars       map[string]string `yaml:"vars,omitempty"`
+	Params     map[string]Param  `yaml:"params,omitempty"`
+	Schedule   *Schedule         `yaml:"schedule,omitempty"` // When to run the action automatically.
+	Production bool              `yaml:"production,omitempty"`
+
+	RequiresApproval bool   `yaml:"requires_approval,omitempty"`
+	Approvers        string `yaml:"approvers,omitempty"` // The group that may approve runs, if not anyone.
+}
+
+type mattermostConfig struct {
+	URL   string
+	Token string
+}
+
+type apiConfig struct {
+	Channel string            // The channel to announce API runs in.
+	Tokens  map[string]string // API tokens keyed by name.
+}
+
+type freezeConfig struct {
+	Windows    []FreezeWindow // When runs are refused.
+	Overriders []AccessRule   // Who may override a freeze, and for what.
+}
+
+type notificationsConfig struct {
+	Admin string // The channel to report configuration problems to.
+	Runs  string // The channel to report the start and end of every run to.
+}
+
+type localConfig struct {
+	Dir string // The directory containing lurch.yml and the playbooks.
+}
+
+type dockerHostConfig struct {
+	Host      string // Defaults to the local docker socket.
+	TLSVerify bool
+	CertPath  string // The directory containing ca.pem, cert.pem and key.pem.
+}
+
+// Endpoint returns the address of the docker daemon.
+func (c dockerHostConfig) Endpoint() string {
+	if c.Host == "" {
+		return defaultDockerHost
+	}
+	return c.Host
 }
 
 type dockerConfig struct {
 	Image string
 	Tag   string
 	Auth  docker.AuthConfiguration
+	Pull  string // When to pull the image: always (the default), missing or never.
 }
@@ -0,0 +1,316 @@
+package main
+
+// This provides Lurch's own configuration file, which is reloaded whenever it
+// changes or Lurch receives a SIGHUP signal.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configPollInterval is how often the configuration file is checked for
+// changes.
+const configPollInterval = 5 * time.Second
+
+// ConfigFile is the structure of the configuration file.  Every setting is
+// optional: those that are missing keep the value given on the command line.
+type ConfigFile struct {
+	// These are only read when Lurch starts.
+	Chat        *string `yaml:"chat"`
+	SlackToken  *string `yaml:"slack-token"`
+	SlackSecret *string `yaml:"slack-signing-secret"`
+	Mattermost  struct {
+		URL   *string `yaml:"url"`
+		Token *string `yaml:"token"`
+	} `yaml:"mattermost"`
+	DockerHost struct {
+		Host      *string `yaml:"host"`
+		TLSVerify *bool   `yaml:"tls-verify"`
+		CertPath  *string `yaml:"cert-path"`
+	} `yaml:"docker-daemon"`
+	History       *string `yaml:"history"`
+	APIListen     *string `yaml:"api-listen"`
+	MetricsListen *string `yaml:"metrics-listen"`
+	WebhookSecret *string `yaml:"registry-webhook-secret"`
+	Debug         *bool   `yaml:"debug"`
+	ConnAttempts  *int    `yaml:"conn-attempts"`
+
+	// These take effect whenever the file is reloaded.
+	EnableDM    *bool   `yaml:"enable-dm"`
+	Executor    *string `yaml:"executor"`
+	DockerImage *string `yaml:"docker-image"`
+	Registry    struct {
+		Username *string `yaml:"username"`
+		Password *string `yaml:"password"`
+		Email    *string `yaml:"email"`
+		Address  *string `yaml:"address"`
+	} `yaml:"registry"`
+	PlaybookDir     *string        `yaml:"playbook-dir"`
+	DisablePull     *bool          `yaml:"disable-pull"`
+	PollInterval    *time.Duration `yaml:"poll-interval"`
+	RunTimeout      *time.Duration `yaml:"run-timeout"`
+	UploadOutput    *string        `yaml:"upload-output"`
+	ApprovalTimeout *time.Duration `yaml:"approval-timeout"`
+	Channels        []string       `yaml:"channels"` // The only channels accepting commands.
+	Notifications   struct {
+		Admin *string `yaml:"admin"`
+		Runs  *string `yaml:"runs"`
+	} `yaml:"notifications"`
+	Access []AccessRule `yaml:"access"`
+	API    struct {
+		Channel *string           `yaml:"channel"`
+		Tokens  map[string]string `yaml:"tokens"` // Keyed by name.
+	} `yaml:"api"`
+	Freeze struct {
+		Windows  []FreezeWindow `yaml:"windows"`
+		Override []AccessRule   `yaml:"override"` // Who may override a freeze.
+	} `yaml:"freeze"`
+	Images     map[string]imageConfig `yaml:"images"` // Used instead of docker-image and registry.
+	Containers []ContainerConfig      `yaml:"containers"`
+}
+
+// imageConfig is the structure of a named devops image in the configuration
+// file.
+type imageConfig struct {
+	Image    string `yaml:"image"`
+	Registry struct {
+		Username string `yaml:"username"`
+		Password string `yaml:"password"`
+		Email    string `yaml:"email"`
+		Address  string `yaml:"address"`
+	} `yaml:"registry"`
+	Pull string `yaml:"pull"` // always, missing or never.
+}
+
+func LoadConfigFile(filename string) (f *ConfigFile, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(filename); err != nil {
+		return
+	}
+
+	f = &ConfigFile{}
+	if err = yaml.Unmarshal(data, f); err != nil {
+		f = nil
+	}
+	return
+}
+
+// ApplyStartup overrides the settings in config that are only read when Lurch
+// starts.
+func (f *ConfigFile) ApplyStartup(config *Config) {
+	setString(&config.Chat, f.Chat)
+	setString(&config.SlackToken, f.SlackToken)
+	setString(&config.SlackSecret, f.SlackSecret)
+	setString(&config.WebhookSecret, f.WebhookSecret)
+	setString(&config.Mattermost.URL, f.Mattermost.URL)
+	setString(&config.Mattermost.Token, f.Mattermost.Token)
+	setString(&config.DockerHost.Host, f.DockerHost.Host)
+	if f.DockerHost.TLSVerify != nil {
+		config.DockerHost.TLSVerify = *f.DockerHost.TLSVerify
+	}
+	setString(&config.DockerHost.CertPath, f.DockerHost.CertPath)
+	setString(&config.HistoryPath, f.History)
+	setString(&config.APIListen, f.APIListen)
+	setString(&config.MetricsListen, f.MetricsListen)
+	if f.Debug != nil {
+		config.Debug = *f.Debug
+	}
+	if f.ConnAttempts != nil {
+		config.ConnAttempts = *f.ConnAttempts
+	}
+}
+
+// ApplySettings overrides s with the settings in the file.
+func (f *ConfigFile) ApplySettings(s *Settings) {
+	if f.EnableDM != nil {
+		s.EnableDM = *f.EnableDM
+	}
+	setString(&s.Executor, f.Executor)
+	if f.DockerImage != nil {
+		s.Docker.Image, s.Docker.Tag = docker.ParseRepositoryTag(*f.DockerImage)
+	}
+	setString(&s.Docker.Auth.Username, f.Registry.Username)
+	setString(&s.Docker.Auth.Password, f.Registry.Password)
+	setString(&s.Docker.Auth.Email, f.Registry.Email)
+	setString(&s.Docker.Auth.ServerAddress, f.Registry.Address)
+	if f.Images != nil {
+		s.Images = make(map[string]dockerConfig)
+		for name, image := range f.Images {
+			c := dockerConfig{
+				Auth: docker.AuthConfiguration{
+					Username:      image.Registry.Username,
+					Password:      image.Registry.Password,
+					Email:         image.Registry.Email,
+					ServerAddress: image.Registry.Address,
+				},
+				Pull: image.Pull,
+			}
+			if image.Image != "" {
+				c.Image, c.Tag = docker.ParseRepositoryTag(image.Image)
+			}
+			s.Images[name] = c
+		}
+	}
+	if f.Containers != nil {
+		s.Containers = f.Containers
+	}
+	setString(&s.Local.Dir, f.PlaybookDir)
+	if f.DisablePull != nil {
+		s.DisablePull = *f.DisablePull
+	}
+	if f.PollInterval != nil {
+		s.PollInterval = *f.PollInterval
+	}
+	if f.RunTimeout != nil {
+		s.RunTimeout = *f.RunTimeout
+	}
+	setString(&s.UploadOutput, f.UploadOutput)
+	if f.ApprovalTimeout != nil {
+		s.ApprovalTimeout = *f.ApprovalTimeout
+	}
+	if f.Channels != nil {
+		s.CommandChannels = f.Channels
+	}
+	setString(&s.Notifications.Admin, f.Notifications.Admin)
+	setString(&s.Notifications.Runs, f.Notifications.Runs)
+	if f.Access != nil {
+		s.AccessRules = f.Access
+	}
+	setString(&s.API.Channel, f.API.Channel)
+	if f.API.Tokens != nil {
+		s.API.Tokens = f.API.Tokens
+	}
+	if f.Freeze.Windows != nil {
+		s.Freeze.Windows = f.Freeze.Windows
+	}
+	if f.Freeze.Override != nil {
+		s.Freeze.Overriders = f.Freeze.Override
+	}
+}
+
+func setString(dst, src *string) {
+	if src != nil {
+		*dst = *src
+	}
+}
+
+// ReloadConfig re-reads the configuration file, applying its settings on top
+// of those given on the command line.  The existing settings are kept if there
+// is an error.
+func ReloadConfig(config *Config) error {
+	f, err := LoadConfigFile(config.File)
+	if err != nil {
+		return err
+	}
+
+	settings := config.flags
+	f.ApplySettings(&settings)
+	if err = settings.Validate(); err != nil {
+		return err
+	}
+
+	config.Lock()
+	config.Settings = settings
+	config.Unlock()
+	config.Access.SetRules(settings.AccessRules)
+	return nil
+}
+
+// notifyAdmin posts text to the admin channel, if there is one.
+func notifyAdmin(chat Chat, config *Config, text string) {
+	if channel := config.Current().Notifications.Admin; channel != "" {
+		chat.Post(channel, text)
+	}
+}
+
+// configModTime returns when the configuration file was last modified, or the
+// zero time if it can't be determined.
+func configModTime(filename string) time.Time {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// watchConfigFile reloads the configuration file whenever it changes or a
+// SIGHUP signal is received.
+func watchConfigFile(chat Chat, config *Config, logger *log.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	modified := configModTime(config.File)
+	for {
+		select {
+		case <-hup:
+			logger.Printf("received SIGHUP signal")
+		case <-ticker.C:
+			if configModTime(config.File).Equal(modified) {
+				continue
+			}
+		}
+		modified = configModTime(config.File)
+
+		old := config.Current()
+		if err := ReloadConfig(config); err != nil {
+			logger.Printf("failed to reload %s: %s", config.File, err)
+			notifyAdmin(chat, config, fmt.Sprintf("I couldn't reload my configuration from `%s` so I'm carrying on with the old one:\n```%s```", config.File, err))
+			continue
+		}
+
+		logger.Printf("reloaded %s", config.File)
+		notifyAdmin(chat, config, fmt.Sprintf("I've reloaded my configuration from `%s`.", config.File))
+
+		// The stacks come from the images, so read them again if those
+		// changed.
+		if imagesChanged(old, config.Current()) {
+			reloadStacks(chat, config, logger)
+		}
+	}
+}
+
+// imagesChanged returns whether the stacks are read from different places
+// with the new settings than with the old.
+func imagesChanged(old, current Settings) bool {
+	return old.Executor != current.Executor || old.Local != current.Local || !reflect.DeepEqual(old.DockerImages(), current.DockerImages())
+}
+
+// reloadStacks reads the stacks from the images again, fetching any that are
+// new, and tells the admin channel how this changes what can be run.
+func reloadStacks(chat Chat, config *Config, logger *log.Logger) {
+	executors, err := NewExecutors(config)
+	if err != nil {
+		logger.Printf("couldn't read the stacks from the new images: %s", err)
+		return
+	}
+
+	config.updating.Lock()
+	defer config.updating.Unlock()
+
+	old := config.Stacks()
+	msg := NewLog(logger)
+	updated, err := updateDevopsImage(msg, executors, config)
+	if err == nil && !updated {
+		err = updateConfigFromImage(msg, executors, config)
+	}
+	if err != nil {
+		logger.Printf("couldn't read the stacks from the new images: %s", err)
+		notifyAdmin(chat, config, fmt.Sprintf("I couldn't read the stacks from the new images, so you may not be able to run some of them:\n```%s```", err))
+		return
+	}
+
+	if changes := describeStackChanges(old, config.Stacks()); changes != "" {
+		notifyAdmin(chat, config, "The new images change what I can run:"+changes)
+	}
+}
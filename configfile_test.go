@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestReloadConfigWhileReading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lurch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "lurch.yml")
+
+	write := func(i int) {
+		data := fmt.Sprintf("executor: local\nplaybook-dir: %s\nupload-output: failed\nchannels: [C%d]\napi:\n  tokens: {ci: token%d}\nnotifications:\n  runs: C%d\n", dir, i, i, i)
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(0)
+
+	config := &Config{File: file, Channels: NewChannels()}
+	config.Access = NewAccess(nil, nil)
+	config.flags.UploadOutput = "failed"
+	if err = ReloadConfig(config); err != nil {
+		t.Fatal(err)
+	}
+	config.Channels.Names["C0"] = Channel
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				settings := config.Current()
+				if settings.Executor != "local" || len(settings.API.Tokens) != 1 {
+					t.Errorf("read incomplete settings: %+v", settings)
+					return
+				}
+				config.AcceptsCommands("C0")
+				if _, err := NewExecutors(config); err != nil {
+					t.Errorf("couldn't create the executors: %s", err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= 20; i++ {
+		write(i)
+		if err = ReloadConfig(config); err != nil {
+			t.Error(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if settings := config.Current(); settings.Notifications.Runs != "C20" || settings.API.Tokens["ci"] != "token20" {
+		t.Errorf("the last reload wasn't applied: %+v", settings)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+// This provides the settings for the containers playbooks are run in, which
+// limit and isolate runs and label them so they can be traced.
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// cpuPeriod is the scheduler period CPU limits are expressed over, in
+// microseconds.
+const cpuPeriod = 100000
+
+// ContainerConfig sets how containers are created for runs from the stacks it
+// matches.  Where several match, those later in the configuration override
+// the settings they give.
+type ContainerConfig struct {
+	Stacks     []string          `yaml:"stacks,omitempty"` // Patterns matching the stacks, all if empty.
+	Memory     string            `yaml:"memory,omitempty"` // As bytes or with a unit e.g. 512m or 2g.
+	CPUs       float64           `yaml:"cpus,omitempty"`
+	Network    string            `yaml:"network,omitempty"` // The network mode e.g. none, host or a network name.
+	DNS        []string          `yaml:"dns,omitempty"`
+	ExtraHosts []string          `yaml:"extra-hosts,omitempty"` // As host:ip.
+	ReadOnly   *bool             `yaml:"read-only,omitempty"`   // Whether the root filesystem is read only.
+	Tmpfs      []string          `yaml:"tmpfs,omitempty"`       // Paths to mount temporary filesystems on.
+	CapDrop    []string          `yaml:"cap-drop,omitempty"`
+	User       string            `yaml:"user,omitempty"`
+	Mounts     []string          `yaml:"mounts,omitempty"` // As source:target or source:target:ro.
+	Labels     map[string]string `yaml:"labels,omitempty"`
+}
+
+// check returns an error if the settings are invalid.
+func (c ContainerConfig) check() error {
+	if c.Memory != "" {
+		if _, err := parseBytes(c.Memory); err != nil {
+			return err
+		}
+	}
+	if c.CPUs < 0 {
+		return fmt.Errorf("cpus can't be negative")
+	}
+	for _, host := range c.ExtraHosts {
+		if parts := strings.SplitN(host, ":", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("%s isn't an extra host such as db:10.0.0.5", host)
+		}
+	}
+	for _, mount := range c.Mounts {
+		parts := strings.Split(mount, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || !path.IsAbs(parts[1]) {
+			return fmt.Errorf("%s isn't a mount such as /run/ssh-agent.sock:/ssh-agent.sock", mount)
+		}
+	}
+	return nil
+}
+
+// matches returns whether the settings apply to stack.  Only settings without
+// stack patterns apply when stack is empty.
+func (c ContainerConfig) matches(stack string) bool {
+	if len(c.Stacks) == 0 {
+		return true
+	} else if stack == "" {
+		return false // Patterns such as * would match.
+	}
+	for _, pattern := range c.Stacks {
+		if ok, _ := path.Match(pattern, stack); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// merge returns c overridden by the settings given in o.
+func (c ContainerConfig) merge(o ContainerConfig) ContainerConfig {
+	if o.Memory != "" {
+		c.Memory = o.Memory
+	}
+	if o.CPUs != 0 {
+		c.CPUs = o.CPUs
+	}
+	if o.Network != "" {
+		c.Network = o.Network
+	}
+	if o.DNS != nil {
+		c.DNS = o.DNS
+	}
+	if o.ExtraHosts != nil {
+		c.ExtraHosts = o.ExtraHosts
+	}
+	if o.ReadOnly != nil {
+		c.ReadOnly = o.ReadOnly
+	}
+	if o.Tmpfs != nil {
+		c.Tmpfs = o.Tmpfs
+	}
+	if o.CapDrop != nil {
+		c.CapDrop = o.CapDrop
+	}
+	if o.User != "" {
+		c.User = o.User
+	}
+	if o.Mounts != nil {
+		c.Mounts = o.Mounts
+	}
+	if len(o.Labels) > 0 {
+		labels := make(map[string]string)
+		for k, v := range c.Labels {
+			labels[k] = v
+		}
+		for k, v := range o.Labels {
+			labels[k] = v
+		}
+		c.Labels = labels
+	}
+	return c
+}
+
+// ContainerFor returns the container settings for runs from stack.  Only the
+// settings that apply to every stack are returned if stack is empty.
+func ContainerFor(stack string, containers []ContainerConfig) (c ContainerConfig) {
+	for _, o := range containers {
+		if o.matches(stack) {
+			c = c.merge(o)
+		}
+	}
+	return
+}
+
+// apply sets the container configuration cfg and hc from the settings.
+func (c ContainerConfig) apply(cfg *docker.Config, hc *docker.HostConfig) (err error) {
+	if c.Memory != "" {
+		if hc.Memory, err = parseBytes(c.Memory); err != nil {
+			return
+		}
+	}
+	if c.CPUs > 0 {
+		hc.CPUPeriod, hc.CPUQuota = cpuPeriod, int64(c.CPUs*cpuPeriod)
+	}
+	hc.NetworkMode = c.Network
+	hc.DNS = c.DNS
+	hc.ExtraHosts = c.ExtraHosts
+	hc.ReadonlyRootfs = c.ReadOnly != nil && *c.ReadOnly
+	if len(c.Tmpfs) > 0 {
+		hc.Tmpfs = make(map[string]string)
+		for _, dir := range c.Tmpfs {
+			hc.Tmpfs[dir] = ""
+		}
+	}
+	hc.CapDrop = c.CapDrop
+	hc.Binds = c.Mounts
+	cfg.User = c.User
+
+	if cfg.Labels == nil {
+		cfg.Labels = make(map[string]string)
+	}
+	for k, v := range c.Labels {
+		cfg.Labels[k] = v
+	}
+	return
+}
+
+// runLabels returns the labels identifying the container for run.
+func runLabels(run *Run) map[string]string {
+	return map[string]string{
+		"lurch.run":       run.ID,
+		"lurch.stack":     run.Stack,
+		"lurch.playbook":  run.Playbook,
+		"lurch.action":    run.Action,
+		"lurch.requester": run.User,
+	}
+}
+
+// parseBytes parses a size such as 512m or 2g into bytes.
+func parseBytes(s string) (int64, error) {
+	units := map[string]int64{"b": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30}
+	value, mult := strings.ToLower(strings.TrimSpace(s)), int64(1)
+	if n := len(value); n > 0 {
+		if m, ok := units[value[n-1:]]; ok {
+			value, mult = value[:n-1], m
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%s isn't a size such as 512m or 2g", s)
+	}
+	return int64(n * float64(mult)), nil
+}
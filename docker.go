@@ -3,8 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,9 +16,36 @@ import (
 	"golang.org/x/net/context"
 )
 
-func getDockerClient() (*docker.Client, error) {
-	endpoint := "unix:///var/run/docker.sock"
-	return docker.NewClient(endpoint)
+// defaultDockerHost is the docker daemon used if none is given.
+const defaultDockerHost = "unix:///var/run/docker.sock"
+
+// NewDockerClient returns a client for the docker daemon given by config.  As
+// with the docker CLI, TLS verification uses the ca.pem, cert.pem and key.pem
+// files in the certificate directory, which defaults to ~/.docker.
+func NewDockerClient(config dockerHostConfig) (*docker.Client, error) {
+	if !config.TLSVerify {
+		return docker.NewClient(config.Endpoint())
+	}
+
+	dir := config.CertPath
+	if dir == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return nil, errors.New("HOME must be set if no docker certificate path is given")
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+
+	// The client skips missing files, and doesn't verify the daemon without
+	// a CA certificate.
+	files := []string{"cert.pem", "key.pem", "ca.pem"}
+	for i, name := range files {
+		files[i] = filepath.Join(dir, name)
+		if _, err := os.Stat(files[i]); err != nil {
+			return nil, err
+		}
+	}
+	return docker.NewTLSClient(config.Endpoint(), files[0], files[1], files[2])
 }
 
 func pullDockerImage(client *docker.Client, image, tag string, auth docker.AuthConfiguration) (result string, err error) {
@@ -59,60 +90,280 @@ func pullDockerImage(client *docker.Client, image, tag string, auth docker.AuthC
 	return
 }
 
-func runDockerCommand(client *docker.Client, image, tag string, args, env []string) (exit int, output []byte, err error) {
-	// Set the timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+// imagePull is a pull of an image in progress, whose result is set once done
+// is closed.
+type imagePull struct {
+	done    chan struct{}
+	updated bool
+	err     error
+}
+
+var (
+	pullsLock sync.Mutex
+	pulls     = make(map[string]*imagePull) // Keyed by image.
+)
 
-	var fullImage string = image
+// pullImageOnce pulls the image, returning whether its ID changed.  If the
+// image is already being pulled, it waits for the result of that pull instead.
+func pullImageOnce(client *docker.Client, image, tag string, auth docker.AuthConfiguration) (bool, error) {
+	ref := image
 	if tag != "" {
-		fullImage += fmt.Sprintf(":%s", tag)
+		ref += ":" + tag
+	}
+
+	pullsLock.Lock()
+	p, ok := pulls[ref]
+	if !ok {
+		p = &imagePull{done: make(chan struct{})}
+		pulls[ref] = p
+	}
+	pullsLock.Unlock()
+	if ok {
+		<-p.done
+		return p.updated, p.err
+	}
+
+	defer func() {
+		pullsLock.Lock()
+		delete(pulls, ref)
+		pullsLock.Unlock()
+		close(p.done)
+	}()
+
+	var before string
+	if i, err := client.InspectImage(ref); err == nil {
+		before = i.ID
+	}
+
+	started := time.Now()
+	if _, p.err = pullDockerImage(client, image, tag, auth); p.err == nil {
+		var i *docker.Image
+		if i, p.err = client.InspectImage(ref); p.err == nil {
+			p.updated = i.ID != before
+		}
 	}
+	observePull(started, p.updated, p.err)
+	return p.updated, p.err
+}
+
+// runDockerCommand runs a container created with cfg and hc, which is removed
+// once it exits.
+func runDockerCommand(ctx context.Context, client *docker.Client, cfg *docker.Config, hc *docker.HostConfig, progress ProgressFunc) (exit int, output []byte, err error) {
+	// Set the timeout for creating the container.
+	createCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
 
 	// Create the container.
 	var cont *docker.Container
+	hc.AutoRemove = true
 	if cont, err = client.CreateContainer(docker.CreateContainerOptions{
 		"",
-		&docker.Config{
-			Image: fullImage,
-			Cmd:   args,
-			Env:   env,
-		},
-		&docker.HostConfig{
-			AutoRemove: true,
-		},
+		cfg,
+		hc,
 		nil,
-		ctx,
+		createCtx,
 	}); err != nil {
 		return
 	}
 
+	// Containers are only removed automatically once they've started.
+	var started bool
+	defer func() {
+		if !started {
+			client.RemoveContainer(docker.RemoveContainerOptions{ID: cont.ID, Force: true})
+		}
+	}()
+
+	// Install the progress callback plugin and separate out its output.  Files
+	// can't be added to a read only container, so its progress isn't
+	// reported.
+	var (
+		buf    bytes.Buffer
+		pw     *progressWriter
+		stderr io.Writer = &buf
+	)
+	if progress != nil && !hc.ReadonlyRootfs {
+		var plugin io.Reader
+		if plugin, err = progressPluginTar(); err != nil {
+			return
+		}
+		if err = client.UploadToContainer(cont.ID, docker.UploadToContainerOptions{
+			InputStream: plugin,
+			Path:        "/",
+		}); err != nil {
+			return
+		}
+
+		pw = newProgressWriter(&buf, progress)
+		stderr = pw
+	}
+
 	// Capture all output from the container. This blocks so run it in parallel
 	// to enable us to start the container.
-	var buf bytes.Buffer
+	attached := make(chan error, 1)
 	go func() {
-		if err = client.AttachToContainer(docker.AttachToContainerOptions{
+		attached <- client.AttachToContainer(docker.AttachToContainerOptions{
 			Container:    cont.ID,
 			OutputStream: &buf,
+			ErrorStream:  stderr,
 			Logs:         true,
 			Stdout:       true,
 			Stderr:       true,
 			Stream:       true,
-		}); err != nil {
-			return
-		}
+		})
 	}()
 
 	// Start the container and begin capturing the output.
 	if err = client.StartContainer(cont.ID, nil); err != nil {
 		return
 	}
+	started = true
+
+	// Stop the container if the context is done before the container exits.
+	exited := make(chan bool)
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.StopContainer(cont.ID, uint(stopGracePeriod/time.Second))
+		case <-exited:
+		}
+	}()
 
 	// Wait for the container to exit, by which time all output should be complete.
 	if exit, err = client.WaitContainer(cont.ID); err != nil {
 		return
 	}
+	if err = <-attached; err != nil {
+		return
+	}
 
+	if pw != nil {
+		pw.Flush()
+	}
 	output = buf.Bytes()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return
+}
+
+// DockerExecutor runs playbooks in containers created from a devops image.
+// Containers are created from the image's digest, so pulling a newer image
+// doesn't affect runs that have started.
+type DockerExecutor struct {
+	client     *docker.Client
+	name       string // The name the image's stacks are recorded under.
+	config     dockerConfig
+	containers []ContainerConfig // Settings for the containers of runs.
+	digests    *ImageDigests
+}
+
+func NewDockerExecutor(client *docker.Client, name string, config dockerConfig, containers []ContainerConfig, digests *ImageDigests) *DockerExecutor {
+	return &DockerExecutor{client, name, config, containers, digests}
+}
+
+// Run implements the Executor interface.  Containers for runs are created
+// with the settings for the run's stack and labelled with the run's details.
+// Other containers get the settings that apply to every stack.
+func (e *DockerExecutor) Run(ctx context.Context, run *Run, args, env []string, progress ProgressFunc) (int, []byte, error) {
+	image := e.Digest()
+	if image == "" {
+		image = e.image()
+	}
+
+	var stack string
+	if run != nil {
+		stack = run.Stack
+	}
+	cfg := &docker.Config{Image: image, Cmd: args, Env: env}
+	hc := &docker.HostConfig{}
+	if err := ContainerFor(stack, e.containers).apply(cfg, hc); err != nil {
+		return 0, nil, err
+	}
+	if run != nil {
+		for k, v := range runLabels(run) {
+			cfg.Labels[k] = v
+		}
+	}
+	return runDockerCommand(ctx, e.client, cfg, hc, progress)
+}
+
+// ReadFile implements the Executor interface.
+func (e *DockerExecutor) ReadFile(name string) (output []byte, err error) {
+	var exit int
+	if exit, output, err = e.Run(context.Background(), nil, []string{"cat", name}, nil, nil); err != nil {
+		return
+	} else if exit != 0 {
+		err = fmt.Errorf("docker command failed: %s", string(output))
+	}
+
 	return
 }
+
+// Update implements the Executor interface by pulling the devops image, as
+// allowed by its pull policy.  A pinned image is only pulled if it's missing.
+func (e *DockerExecutor) Update(msg Conversation) (bool, error) {
+	if pinned := e.digests.Pinned(e.name); pinned != "" {
+		if _, err := e.client.InspectImage(pinned); err == nil {
+			return false, nil
+		}
+		return pullDevopsImage(msg, e.client, pinned, "", e.config.Auth)
+	}
+
+	switch e.config.Pull {
+	case "never":
+		return false, nil
+	case "missing":
+		if _, err := e.client.InspectImage(e.image()); err == nil {
+			return false, nil
+		}
+	}
+	return pullDevopsImage(msg, e.client, e.config.Image, e.config.Tag, e.config.Auth)
+}
+
+// Digest implements the Executor interface, returning the digest the image is
+// pinned to or else the repository digest of the local devops image, failing
+// which its ID.  The digest is recorded in the image's history.
+func (e *DockerExecutor) Digest() string {
+	if pinned := e.digests.Pinned(e.name); pinned != "" {
+		return pinned
+	}
+
+	image, err := e.client.InspectImage(e.image())
+	if err != nil {
+		return ""
+	}
+	digest := image.ID
+	for _, d := range image.RepoDigests {
+		if strings.HasPrefix(d, e.config.Image+"@") {
+			digest = d
+			break
+		}
+	}
+
+	// Not recording the digest shouldn't stop playbooks running.
+	e.digests.Seen(e.name, digest)
+	return digest
+}
+
+// Replicate implements the Executor interface.
+func (e *DockerExecutor) Replicate(args []string) string {
+	// Image IDs can't be pulled, unlike repository digests.
+	image := e.Digest()
+	if !strings.Contains(image, "@") {
+		image = e.image()
+	}
+	return fmt.Sprintf("docker pull %s && \\\ndocker run -t --rm %s %s", image, image, shellJoin(args))
+}
+
+func (e *DockerExecutor) String() string {
+	return fmt.Sprintf("the %s image", e.image())
+}
+
+func (e *DockerExecutor) image() string {
+	if e.config.Tag == "" {
+		return e.config.Image
+	}
+	return strings.Join([]string{e.config.Image, e.config.Tag}, ":")
+}
@@ -0,0 +1,258 @@
+package main
+
+// This provides the abstraction over how Ansible playbooks are run.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Executor is implemented by each mechanism Lurch can use to run playbooks.
+type Executor interface {
+	// Run runs the command args with the additional environment variables env,
+	// returning the exit code and the combined stdout and stderr output.  If
+	// progress is not nil, the progress callback plugin is enabled and its
+	// events are passed to progress instead of being included in the output.
+	// The command is stopped if ctx is done, in which case the output so far
+	// is returned along with the context's error.
+	Run(ctx context.Context, run *Run, args, env []string, progress ProgressFunc) (exit int, output []byte, err error)
+
+	// ReadFile returns the contents of the named file relative to the
+	// directory in which playbooks are run.
+	ReadFile(name string) ([]byte, error)
+
+	// Update checks for newer playbooks, notifying msg of progress and
+	// returning whether an update was made.
+	Update(msg Conversation) (updated bool, err error)
+
+	// Digest returns an identifier for the version of the playbooks being run,
+	// or an empty string if there isn't one.
+	Digest() string
+
+	// Replicate returns a shell command a user can use to replicate running
+	// args.
+	Replicate(args []string) string
+
+	// String describes where the playbooks come from.
+	String() string
+}
+
+// stopGracePeriod is how long a command is given to exit after being asked to
+// stop, before it is killed.
+const stopGracePeriod = 10 * time.Second
+
+// shellJoin joins args into a command line, quoting them where necessary.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=+:,./@") == "" {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Executors holds an Executor for each source of playbooks, keyed by the
+// name its stacks are recorded under.
+type Executors map[string]Executor
+
+// NewExecutors returns the Executor implementations selected by config: one
+// per devops image, or one for the local playbook directory.
+func NewExecutors(config *Config) (executors Executors, err error) {
+	settings := config.Current()
+	switch settings.Executor {
+	case "docker":
+		if config.DockerClient == nil {
+			err = errors.New("there's no docker client")
+			return
+		}
+		executors = make(Executors)
+		for name, image := range settings.DockerImages() {
+			executors[name] = NewDockerExecutor(config.DockerClient, name, image, settings.Containers, config.Digests)
+		}
+	case "local":
+		var e *LocalExecutor
+		if e, err = NewLocalExecutor(settings.Local.Dir); err == nil {
+			executors = Executors{"local": e}
+		}
+	default:
+		err = fmt.Errorf("unknown executor: %s", settings.Executor)
+	}
+	return
+}
+
+// Names returns an ordered list of the names of the executors.
+func (e Executors) Names() (names []string) {
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return
+}
+
+// For returns the executor that runs the playbooks from stack.
+func (e Executors) For(stack string, config *Config) (Executor, error) {
+	st, ok := config.Stacks()[stack]
+	if !ok {
+		return nil, fmt.Errorf("I don't know anything about the *%s* stack", stack)
+	}
+	executor, ok := e[st.Image]
+	if !ok {
+		return nil, fmt.Errorf("the %s image that *%s* comes from is no longer configured", st.Image, stack)
+	}
+	return executor, nil
+}
+
+// LocalExecutor runs playbooks as local subprocesses.
+type LocalExecutor struct {
+	Dir string // The working directory for playbooks.
+}
+
+var (
+	localPluginDir  string // Where the progress callback plugin is installed.
+	localPluginErr  error
+	localPluginOnce sync.Once
+)
+
+// installLocalPlugin writes the progress callback plugin to a temporary
+// directory, returning the directory.
+func installLocalPlugin() (string, error) {
+	localPluginOnce.Do(func() {
+		var dir string
+		if dir, localPluginErr = ioutil.TempDir("", "lurch"); localPluginErr != nil {
+			return
+		}
+		localPluginErr = ioutil.WriteFile(filepath.Join(dir, progressPluginName), []byte(progressPlugin), 0644)
+		localPluginDir = dir
+	})
+
+	return localPluginDir, localPluginErr
+}
+
+func NewLocalExecutor(dir string) (e *LocalExecutor, err error) {
+	if dir, err = filepath.Abs(dir); err != nil {
+		return
+	}
+
+	var fi os.FileInfo
+	if fi, err = os.Stat(dir); err != nil {
+		return
+	} else if !fi.IsDir() {
+		err = fmt.Errorf("%s is not a directory", dir)
+		return
+	}
+
+	e = &LocalExecutor{dir}
+	return
+}
+
+// Run implements the Executor interface.
+func (e *LocalExecutor) Run(ctx context.Context, run *Run, args, env []string, progress ProgressFunc) (exit int, output []byte, err error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = e.Dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true} // So that children can be signalled.
+
+	var (
+		buf bytes.Buffer
+		pw  *progressWriter
+	)
+	stdout := &lockedWriter{w: &buf}
+	cmd.Stdout, cmd.Stderr = stdout, stdout
+
+	if progress != nil {
+		// Add the plugin to the existing callback plugin path.
+		var dir string
+		if dir, err = installLocalPlugin(); err != nil {
+			return
+		}
+		plugins := os.Getenv("ANSIBLE_CALLBACK_PLUGINS")
+		if plugins == "" {
+			plugins = "~/.ansible/plugins/callback:" + progressPluginDir
+		}
+		cmd.Env = append(cmd.Env, fmt.Sprintf("ANSIBLE_CALLBACK_PLUGINS=%s:%s", dir, plugins))
+
+		pw = newProgressWriter(stdout, progress)
+		cmd.Stderr = pw
+	}
+
+	if err = cmd.Start(); err != nil {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Ask the process group to terminate before killing it.
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		select {
+		case err = <-done:
+		case <-time.After(stopGracePeriod):
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			err = <-done
+		}
+	}
+
+	if err != nil {
+		// A non-zero exit status is reported via the exit code, not an error.
+		if eerr, ok := err.(*exec.ExitError); ok {
+			if status, ok := eerr.Sys().(syscall.WaitStatus); ok {
+				exit, err = status.ExitStatus(), nil
+			}
+		}
+	}
+
+	if pw != nil {
+		pw.Flush()
+	}
+	output = buf.Bytes()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return
+}
+
+// ReadFile implements the Executor interface.
+func (e *LocalExecutor) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(e.Dir, name))
+}
+
+// Update implements the Executor interface.  Local playbooks are managed
+// outside of Lurch so there is nothing to update.
+func (e *LocalExecutor) Update(msg Conversation) (bool, error) {
+	return false, nil
+}
+
+// Digest implements the Executor interface.  Local playbooks aren't versioned
+// by Lurch.
+func (e *LocalExecutor) Digest() string {
+	return ""
+}
+
+// Replicate implements the Executor interface.
+func (e *LocalExecutor) Replicate(args []string) string {
+	return fmt.Sprintf("cd %s && \\\n%s", e.Dir, shellJoin(args))
+}
+
+func (e *LocalExecutor) String() string {
+	return fmt.Sprintf("the %s directory", e.Dir)
+}
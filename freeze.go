@@ -0,0 +1,400 @@
+package main
+
+// This provides change freezes, during which playbooks may only be run by
+// those allowed to override the freeze.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FreezeWindow declares a period during which runs are refused.  It is either
+// fixed, running From one time To another, or recurring, running from Start to
+// End every week, or every day if they don't give a day.
+type FreezeWindow struct {
+	Stacks   []string `yaml:"stacks,omitempty"` // Patterns matching the stacks frozen, all if empty.
+	From     string   `yaml:"from,omitempty"`   // As 2006-01-02 or 2006-01-02 15:04.
+	To       string   `yaml:"to,omitempty"`
+	Start    string   `yaml:"start,omitempty"` // As Mon 15:04 or 15:04.
+	End      string   `yaml:"end,omitempty"`
+	Timezone string   `yaml:"timezone,omitempty"` // UTC if not given.
+	Reason   string   `yaml:"reason,omitempty"`
+}
+
+var freezeDateLayouts = []string{"2006-01-02 15:04", "2006-01-02"}
+
+// check returns an error if the window is invalid.
+func (w FreezeWindow) check() error {
+	_, _, err := w.active(time.Now())
+	return err
+}
+
+// frozen returns whether the window applies to stack.
+func (w FreezeWindow) frozen(stack string) bool {
+	if len(w.Stacks) == 0 {
+		return true
+	}
+	for _, pattern := range w.Stacks {
+		if ok, _ := path.Match(pattern, stack); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// active returns whether the window covers now and, if so, when it ends.
+func (w FreezeWindow) active(now time.Time) (ok bool, until time.Time, err error) {
+	loc := time.UTC
+	if w.Timezone != "" {
+		if loc, err = time.LoadLocation(w.Timezone); err != nil {
+			return
+		}
+	}
+	now = now.In(loc)
+
+	switch {
+	case w.From != "" && w.To != "" && w.Start == "" && w.End == "":
+		var from time.Time
+		if from, err = parseFreezeDate(w.From, loc); err != nil {
+			return
+		}
+		if until, err = parseFreezeDate(w.To, loc); err != nil {
+			return
+		}
+		ok = !now.Before(from) && now.Before(until)
+
+	case w.Start != "" && w.End != "" && w.From == "" && w.To == "":
+		var start, end, period time.Duration
+		var weekly bool
+		if start, weekly, err = parseFreezeTime(w.Start); err != nil {
+			return
+		}
+		var endWeekly bool
+		if end, endWeekly, err = parseFreezeTime(w.End); err != nil {
+			return
+		}
+		if weekly != endWeekly {
+			err = errors.New("the start and end of a recurring freeze must both give a day, or neither")
+			return
+		}
+
+		// Measure times from the start of the day or week.
+		offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+		period = 24 * time.Hour
+		if weekly {
+			offset += time.Duration(now.Weekday()) * period
+			period *= 7
+		}
+
+		if start < end {
+			ok = offset >= start && offset < end
+		} else {
+			ok = offset >= start || offset < end
+		}
+		if ok {
+			until = now.Add((end - offset + period) % period)
+		}
+
+	default:
+		err = errors.New("a freeze needs either `from` and `to` or `start` and `end`")
+	}
+	return
+}
+
+func parseFreezeDate(value string, loc *time.Location) (t time.Time, err error) {
+	for _, layout := range freezeDateLayouts {
+		if t, err = time.ParseInLocation(layout, value, loc); err == nil {
+			return
+		}
+	}
+	err = fmt.Errorf("%s isn't a date such as 2006-01-02 or 2006-01-02 15:04", value)
+	return
+}
+
+// parseFreezeTime parses a time such as Mon 15:04 or 15:04, returning it as
+// an offset from the start of the week or day respectively.
+func parseFreezeTime(value string) (offset time.Duration, weekly bool, err error) {
+	fields := strings.Fields(value)
+	if len(fields) == 2 {
+		weekly = true
+		day := -1
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			if strings.EqualFold(fields[0], d.String()[:3]) || strings.EqualFold(fields[0], d.String()) {
+				day = int(d)
+			}
+		}
+		if day < 0 {
+			err = fmt.Errorf("%s isn't a day of the week", fields[0])
+			return
+		}
+		offset = time.Duration(day) * 24 * time.Hour
+		fields = fields[1:]
+	}
+
+	var t time.Time
+	if len(fields) != 1 {
+		err = fmt.Errorf("%s isn't a time such as Fri 16:00 or 16:00", value)
+	} else if t, err = time.Parse("15:04", fields[0]); err != nil {
+		err = fmt.Errorf("%s isn't a time such as Fri 16:00 or 16:00", value)
+	} else {
+		offset += time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return
+}
+
+// Freeze is a freeze that is in force.
+type Freeze struct {
+	Stack  string // The stack frozen, or * for all of them.
+	Reason string
+	By     string // The mention string for the user who froze the stack, if not declared in the configuration.
+	Until  time.Time
+}
+
+func (f *Freeze) String() (text string) {
+	if f.Stack == "*" {
+		text = "every stack is frozen"
+	} else {
+		text = fmt.Sprintf("*%s* is frozen", f.Stack)
+	}
+	text += " until " + f.Until.Format("Mon 2 Jan 15:04 MST")
+	if f.By != "" {
+		text += " by " + f.By
+	}
+	if f.Reason != "" {
+		text += ": " + Desentence(f.Reason)
+	}
+	return
+}
+
+// Freezes holds the freezes made from chat.  Freezes declared in the
+// configuration are passed in as windows.
+type Freezes struct {
+	sync.Mutex
+	adhoc map[string]*Freeze // Keyed by stack.
+}
+
+func NewFreezes() *Freezes {
+	return &Freezes{adhoc: make(map[string]*Freeze)}
+}
+
+// Add puts freeze in force, replacing any other freeze made from chat for the
+// same stack.
+func (f *Freezes) Add(freeze *Freeze) {
+	f.Lock()
+	defer f.Unlock()
+	f.adhoc[freeze.Stack] = freeze
+}
+
+// Remove lifts the freeze made from chat for stack, returning it.
+func (f *Freezes) Remove(stack string) (*Freeze, error) {
+	f.Lock()
+	defer f.Unlock()
+	freeze, ok := f.adhoc[stack]
+	if !ok || !time.Now().Before(freeze.Until) {
+		return nil, fmt.Errorf("there's no freeze on *%s* that I can lift", stack)
+	}
+	delete(f.adhoc, stack)
+	return freeze, nil
+}
+
+// List returns the freezes in force at now, ordered by stack.
+func (f *Freezes) List(windows []FreezeWindow, now time.Time) (freezes []*Freeze) {
+	f.Lock()
+	defer f.Unlock()
+	for stack, freeze := range f.adhoc {
+		if now.Before(freeze.Until) {
+			freezes = append(freezes, freeze)
+		} else {
+			delete(f.adhoc, stack)
+		}
+	}
+
+	for _, w := range windows {
+		if ok, until, err := w.active(now); err == nil && ok {
+			stack := "*"
+			if len(w.Stacks) > 0 {
+				stack = strings.Join(w.Stacks, ", ")
+			}
+			freezes = append(freezes, &Freeze{Stack: stack, Reason: w.Reason, Until: until})
+		}
+	}
+
+	sort.Sort(freezesByStack(freezes))
+	return
+}
+
+// Active returns a freeze on stack in force at now, or nil if there isn't one.
+func (f *Freezes) Active(stack string, windows []FreezeWindow, now time.Time) *Freeze {
+	f.Lock()
+	for _, s := range []string{stack, "*"} {
+		if freeze, ok := f.adhoc[s]; ok && now.Before(freeze.Until) {
+			f.Unlock()
+			return freeze
+		}
+	}
+	f.Unlock()
+
+	for _, w := range windows {
+		if !w.frozen(stack) {
+			continue
+		}
+		if ok, until, err := w.active(now); err == nil && ok {
+			s := stack
+			if len(w.Stacks) == 0 {
+				s = "*"
+			}
+			return &Freeze{Stack: s, Reason: w.Reason, Until: until}
+		}
+	}
+	return nil
+}
+
+type freezesByStack []*Freeze
+
+func (f freezesByStack) Len() int           { return len(f) }
+func (f freezesByStack) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f freezesByStack) Less(i, j int) bool { return f[i].Stack < f[j].Stack }
+
+// checkFreeze returns an error if stack is frozen and who may not override
+// the freeze with the reason given in opts.
+func checkFreeze(who *Identity, stack, playbook, action string, opts *RunOptions, config *Config) error {
+	settings := config.Current()
+	freeze := config.Freezes.Active(stack, settings.Freeze.Windows, time.Now())
+	if freeze == nil {
+		opts.OverrideFreeze = "" // There's nothing to override.
+		return nil
+	} else if who == nil { // Scheduled runs can't override a freeze.
+		return errors.New(Sentence(freeze.String(), "."))
+	} else if opts.OverrideFreeze == "" {
+		return fmt.Errorf("I'm sorry, %s.  If it can't wait, add `--override-freeze \"<reason>\"`.", freeze)
+	}
+
+	ok, err := config.Access.Grants(who.ID, settings.Freeze.Overriders, stack, playbook, action)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("I'm sorry, %s and you're not allowed to override the freeze.", freeze)
+	}
+	return nil
+}
+
+// logFreezeOverride logs that who is overriding a freeze with run.
+func logFreezeOverride(logger *log.Logger, who *Identity, run *Run) {
+	logger.Printf("%s is overriding the freeze on %s for %s because %s", who.ID, run.Stack, run.ID, run.Options.OverrideFreeze)
+}
+
+// frozenRun returns the freeze that now stops run going ahead, or nil if it
+// may go ahead.  Freezes are checked when runs are requested, but the stack may
+// have been frozen while the run waited.  Plans and runs that overrode a freeze
+// when they were requested may go ahead.
+func frozenRun(run *Run, config *Config) *Freeze {
+	if run.Plan || (run.Options != nil && run.Options.OverrideFreeze != "") {
+		return nil
+	}
+	return config.Freezes.Active(run.Stack, config.Current().Freeze.Windows, time.Now())
+}
+
+// dropFrozen tells the requester that run has been dropped because of freeze.
+func dropFrozen(msg *Message, run *Run, freeze *Freeze) {
+	msg.Reply(fmt.Sprintf("%s I've dropped `%s` (*%s %s*) as %s.", run.Requester, run.ID, run.Stack, run.Playbook, freeze))
+}
+
+// processFreeze lists the freezes in force, or freezes a stack for a while.
+func processFreeze(msg *Message, cmd []string, config *Config) {
+	if len(cmd) == 0 {
+		freezes := config.Freezes.List(config.Current().Freeze.Windows, time.Now())
+		if len(freezes) == 0 {
+			msg.Reply("Nothing is frozen at the moment.")
+			return
+		}
+
+		var lines []string
+		for _, freeze := range freezes {
+			lines = append(lines, Sentence(freeze.String(), "."))
+		}
+		msg.Reply(fmt.Sprintf("These freezes are in force:\n  • %s", strings.Join(lines, "\n  • ")))
+		return
+	} else if len(cmd) < 3 {
+		msg.Reply("I need to know the stack to freeze, for how long and why, e.g. *`freeze my-website 2h investigating the outage`*.")
+		return
+	}
+
+	stack := cmd[0]
+	duration, err := time.ParseDuration(cmd[1])
+	if err != nil || duration <= 0 {
+		msg.Reply(fmt.Sprintf("I'm sorry, `%s` isn't a duration such as 30m or 2h.", cmd[1]))
+		return
+	}
+	if !mayFreeze(msg, stack, config) {
+		return
+	}
+
+	freeze := &Freeze{
+		Stack:  stack,
+		Reason: strings.Join(cmd[2:], " "),
+		By:     msg.ev.UserMention,
+		Until:  time.Now().Add(duration),
+	}
+	config.Freezes.Add(freeze)
+	msg.Reply(fmt.Sprintf("OK, %s.", freeze))
+}
+
+// processUnfreeze lifts a freeze made from chat.
+func processUnfreeze(msg *Message, cmd []string, config *Config) {
+	if len(cmd) != 1 {
+		msg.Reply("Use *`unfreeze <stack>`* to lift a freeze, or *`unfreeze *`* to lift a freeze on every stack.")
+		return
+	}
+
+	stack := cmd[0]
+	if !mayFreeze(msg, stack, config) {
+		return
+	}
+
+	if _, err := config.Freezes.Remove(stack); err != nil {
+		msg.Reply(fmt.Sprintf("I'm sorry, %s.  Freezes in my configuration file can only be lifted by changing it.", err))
+		return
+	}
+	if stack == "*" {
+		msg.Reply("OK, I've lifted the freeze on every stack.")
+	} else {
+		msg.Reply(fmt.Sprintf("OK, I've lifted the freeze on *%s*.", stack))
+	}
+}
+
+// mayFreeze returns whether the user may freeze stack, replying if they
+// can't.  Users may freeze the stacks they may run something from, and may
+// only freeze every stack if they may run something from all of them.
+func mayFreeze(msg *Message, stack string, config *Config) bool {
+	who := identify(msg, config)
+	if who == nil {
+		return false
+	}
+
+	allowed := config.Access.Stacks(who, config)
+	if stack == "*" {
+		if len(allowed) == len(config.Stacks()) {
+			return true
+		}
+		msg.Reply("I'm sorry, you can only freeze every stack if you're allowed to run all of them.")
+		return false
+	}
+
+	if _, ok := config.Stacks()[stack]; !ok {
+		msg.Reply(fmt.Sprintf("Oh dear.  I'm afraid I don't know anything about the *%s* stack.", stack))
+		return false
+	}
+	for _, s := range allowed {
+		if s == stack {
+			return true
+		}
+	}
+	msg.Reply(fmt.Sprintf("I'm sorry, you're not allowed to freeze *%s*.", stack))
+	return false
+}
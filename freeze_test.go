@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// freezeTime returns the time given as 2006-01-02 15:04 in UTC.
+func freezeTime(t *testing.T, value string) time.Time {
+	tm, err := time.Parse("2006-01-02 15:04", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func TestFreezeWindowActive(t *testing.T) {
+	weekend := FreezeWindow{Start: "Fri 16:00", End: "Mon 08:00"}
+	nightly := FreezeWindow{Start: "22:00", End: "06:00"}
+	fixed := FreezeWindow{From: "2026-10-16", To: "2026-10-19 12:00"}
+	berlin := FreezeWindow{Start: "09:00", End: "17:00", Timezone: "Europe/Berlin"}
+
+	// 2026-10-16 is a Friday.
+	tests := []struct {
+		name   string
+		window FreezeWindow
+		now    string
+		until  string // Empty if the window isn't active.
+	}{
+		{"before the weekend", weekend, "2026-10-16 15:59", ""},
+		{"start of the weekend", weekend, "2026-10-16 16:00", "2026-10-19 08:00"},
+		{"saturday", weekend, "2026-10-17 12:00", "2026-10-19 08:00"},
+		{"sunday, after the week starts", weekend, "2026-10-18 09:00", "2026-10-19 08:00"},
+		{"monday morning", weekend, "2026-10-19 07:59", "2026-10-19 08:00"},
+		{"end of the weekend", weekend, "2026-10-19 08:00", ""},
+		{"midweek", weekend, "2026-10-14 12:00", ""},
+		{"before midnight", nightly, "2026-10-16 23:00", "2026-10-17 06:00"},
+		{"after midnight", nightly, "2026-10-17 05:00", "2026-10-17 06:00"},
+		{"daytime", nightly, "2026-10-17 12:00", ""},
+		{"before the fixed window", fixed, "2026-10-15 23:59", ""},
+		{"start of the fixed window", fixed, "2026-10-16 00:00", "2026-10-19 12:00"},
+		{"end of the fixed window", fixed, "2026-10-19 12:00", ""},
+		{"in another timezone", berlin, "2026-10-16 07:30", "2026-10-16 15:00"},
+		{"after hours in another timezone", berlin, "2026-10-16 15:30", ""},
+	}
+
+	for _, test := range tests {
+		ok, until, err := test.window.active(freezeTime(t, test.now))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if ok != (test.until != "") {
+			t.Errorf("%s: expected active to be %t, got %t", test.name, test.until != "", ok)
+		} else if ok && !until.Equal(freezeTime(t, test.until)) {
+			t.Errorf("%s: expected it to end at %s, got %s", test.name, test.until, until.UTC())
+		}
+	}
+}
+
+func TestFreezeWindowCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		window FreezeWindow
+		valid  bool
+	}{
+		{"weekly", FreezeWindow{Start: "fri 16:00", End: "Monday 08:00"}, true},
+		{"daily", FreezeWindow{Start: "22:00", End: "06:00"}, true},
+		{"fixed", FreezeWindow{From: "2026-12-24", To: "2027-01-02 09:00"}, true},
+		{"empty", FreezeWindow{}, false},
+		{"only a start", FreezeWindow{Start: "16:00"}, false},
+		{"fixed and recurring", FreezeWindow{From: "2026-12-24", To: "2027-01-02", Start: "16:00", End: "08:00"}, false},
+		{"mixed days", FreezeWindow{Start: "Fri 16:00", End: "08:00"}, false},
+		{"invalid day", FreezeWindow{Start: "Fry 16:00", End: "Mon 08:00"}, false},
+		{"invalid time", FreezeWindow{Start: "25:00", End: "08:00"}, false},
+		{"invalid date", FreezeWindow{From: "tomorrow", To: "2027-01-02"}, false},
+		{"invalid timezone", FreezeWindow{Start: "22:00", End: "06:00", Timezone: "Nowhere/Else"}, false},
+	}
+	for _, test := range tests {
+		if err := test.window.check(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid to be %t, got %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestFreezesActive(t *testing.T) {
+	now := freezeTime(t, "2026-10-17 12:00")
+	windows := []FreezeWindow{{Stacks: []string{"web*"}, Start: "Fri 16:00", End: "Mon 08:00", Reason: "Weekend"}}
+	freezes := NewFreezes()
+
+	if freeze := freezes.Active("website", windows, now); freeze == nil || freeze.Stack != "website" || freeze.Reason != "Weekend" {
+		t.Errorf("expected website to be frozen for the weekend, got %#v", freeze)
+	}
+	if freeze := freezes.Active("api", windows, now); freeze != nil {
+		t.Errorf("expected api not to be frozen, got %#v", freeze)
+	}
+
+	freezes.Add(&Freeze{Stack: "*", Reason: "Outage", Until: now.Add(time.Hour)})
+	if freeze := freezes.Active("api", windows, now); freeze == nil || freeze.Reason != "Outage" {
+		t.Errorf("expected api to be frozen for the outage, got %#v", freeze)
+	}
+	if freeze := freezes.Active("api", windows, now.Add(time.Hour)); freeze != nil {
+		t.Errorf("expected the outage freeze to have ended, got %#v", freeze)
+	}
+}
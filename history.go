@@ -0,0 +1,237 @@
+package main
+
+// This provides a persistent record of playbook runs.
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var (
+	runsBucket    = []byte("runs")    // Run records keyed by ID.
+	startedBucket = []byte("started") // Run IDs keyed by start time.
+	imagesBucket  = []byte("images")  // ImageRecords keyed by image name.
+
+	errHistoryDisabled = errors.New("my run history is disabled")
+	errRunNotFound     = errors.New("I don't have a record of that run")
+)
+
+// RunRecord is the historical record of a run.
+type RunRecord struct {
+	ID        string            `json:"id"`
+	User      string            `json:"user"`      // The ID of the requesting user.
+	Requester string            `json:"requester"` // The mention string for the requesting user.
+	Requested time.Time         `json:"requested"`
+	Approver  string            `json:"approver,omitempty"` // The ID of the approving user.
+	Approval  string            `json:"approval,omitempty"` // The mention string for the approving user.
+	Approved  time.Time         `json:"approved"`
+	Channel   string            `json:"channel"`
+	Stack     string            `json:"stack"`
+	Playbook  string            `json:"playbook"`
+	Action    string            `json:"action"`
+	Plan      bool              `json:"plan,omitempty"`   // Whether this was a dry run in check mode.
+	Digest    string            `json:"digest,omitempty"` // Identifies the playbooks that were run.
+	Vars      map[string]string `json:"vars,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	Options   *RunOptions       `json:"options,omitempty"`
+	Start     time.Time         `json:"start"`
+	End       time.Time         `json:"end"`
+	Exit      int               `json:"exit"`
+	Error     string            `json:"error,omitempty"`   // Set if the playbook couldn't be run.
+	Stopped   string            `json:"stopped,omitempty"` // Why the run was stopped before it completed.
+	Results   *Results          `json:"results,omitempty"`
+	Output    string            `json:"output"`
+}
+
+func NewRunRecord(run *Run) *RunRecord {
+	return &RunRecord{
+		ID:        run.ID,
+		User:      run.User,
+		Requester: run.Requester,
+		Requested: run.Queued,
+		Approver:  run.Approver,
+		Approval:  run.Approval,
+		Approved:  run.Approved,
+		Channel:   run.Channel,
+		Stack:     run.Stack,
+		Playbook:  run.Playbook,
+		Action:    run.Action,
+		Plan:      run.Plan,
+		Vars:      run.Vars,
+		Params:    run.Params,
+		Options:   run.Options,
+		Start:     time.Now(),
+	}
+}
+
+// Outcome describes the result of the run.
+func (r *RunRecord) Outcome() string {
+	switch {
+	case r.End.IsZero():
+		return "running"
+	case r.Stopped != "":
+		return r.Stopped
+	case r.Error != "":
+		return "errored"
+	case r.Exit != 0:
+		return "failed"
+	}
+	return "succeeded"
+}
+
+// History stores RunRecords in an embedded database.  A nil History is valid
+// and records nothing.
+type History struct {
+	db *bolt.DB
+}
+
+func OpenHistory(path string) (h *History, err error) {
+	var db *bolt.DB
+	if db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second}); err != nil {
+		return
+	}
+
+	if err = db.Update(func(tx *bolt.Tx) (err error) {
+		if _, err = tx.CreateBucketIfNotExists(runsBucket); err != nil {
+			return
+		}
+		if _, err = tx.CreateBucketIfNotExists(startedBucket); err != nil {
+			return
+		}
+		_, err = tx.CreateBucketIfNotExists(imagesBucket)
+		return
+	}); err != nil {
+		db.Close()
+		return
+	}
+
+	h = &History{db}
+	return
+}
+
+func (h *History) Close() error {
+	if h == nil {
+		return nil
+	}
+	return h.db.Close()
+}
+
+// startedKey returns a key ordering records by start time.
+func startedKey(rec *RunRecord) []byte {
+	key := make([]byte, 8, 8+len(rec.ID))
+	binary.BigEndian.PutUint64(key, uint64(rec.Start.UnixNano()))
+	return append(key, rec.ID...)
+}
+
+// Save stores rec, replacing any existing record with the same ID.
+func (h *History) Save(rec *RunRecord) error {
+	if h == nil {
+		return nil
+	}
+
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) (err error) {
+		if err = tx.Bucket(runsBucket).Put([]byte(rec.ID), value); err != nil {
+			return
+		}
+		return tx.Bucket(startedBucket).Put(startedKey(rec), []byte(rec.ID))
+	})
+}
+
+// Get returns the record for the run identified by id.
+func (h *History) Get(id string) (rec *RunRecord, err error) {
+	if h == nil {
+		err = errHistoryDisabled
+		return
+	}
+
+	err = h.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(runsBucket).Get([]byte(id))
+		if value == nil {
+			return errRunNotFound
+		}
+		return json.Unmarshal(value, &rec)
+	})
+	return
+}
+
+// Recent returns up to n of the most recently started runs for which include
+// returns true, newest first.
+func (h *History) Recent(n int, include func(rec *RunRecord) bool) (recs []*RunRecord, err error) {
+	if h == nil {
+		err = errHistoryDisabled
+		return
+	}
+
+	err = h.db.View(func(tx *bolt.Tx) error {
+		runs := tx.Bucket(runsBucket)
+		c := tx.Bucket(startedBucket).Cursor()
+		for k, id := c.Last(); k != nil && len(recs) < n; k, id = c.Prev() {
+			var rec *RunRecord
+			if err := json.Unmarshal(runs.Get(id), &rec); err != nil {
+				return err
+			}
+			if include(rec) {
+				recs = append(recs, rec)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// ImageRecord is the historical record of the digests of a devops image.
+type ImageRecord struct {
+	Digests []ImageDigest `json:"digests"`          // Oldest first.
+	Pinned  string        `json:"pinned,omitempty"` // The digest used instead of the latest, if any.
+}
+
+// ImageDigest is a digest a devops image has had.
+type ImageDigest struct {
+	Digest string    `json:"digest"`
+	Seen   time.Time `json:"seen"` // When it was first used.
+}
+
+// SaveImage stores rec as the record for the named image.
+func (h *History) SaveImage(name string, rec *ImageRecord) error {
+	if h == nil {
+		return nil
+	}
+
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	return h.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(imagesBucket).Put([]byte(name), value)
+	})
+}
+
+// Images returns the records of every image, keyed by name.
+func (h *History) Images() (recs map[string]*ImageRecord, err error) {
+	recs = make(map[string]*ImageRecord)
+	if h == nil {
+		return
+	}
+
+	err = h.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(imagesBucket).ForEach(func(k, v []byte) error {
+			var rec *ImageRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			recs[string(k)] = rec
+			return nil
+		})
+	})
+	return
+}
@@ -0,0 +1,245 @@
+package main
+
+// This provides the record of the devops image digests playbooks are run
+// from, and pinning an image to an earlier digest.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imageHistoryLength is the most digests recorded for each image.
+const imageHistoryLength = 20
+
+// ImageDigests holds the digests each devops image has had, and any digest it
+// is pinned to, saving them to the run history if there is one.
+type ImageDigests struct {
+	sync.Mutex
+	history *History
+	images  map[string]*ImageRecord // Keyed by image name.
+}
+
+func NewImageDigests(history *History) (d *ImageDigests, err error) {
+	d = &ImageDigests{history: history}
+	d.images, err = history.Images()
+	return
+}
+
+// record returns the record for the named image, creating it if needed.  The
+// caller must hold the lock.
+func (d *ImageDigests) record(name string) *ImageRecord {
+	rec, ok := d.images[name]
+	if !ok {
+		rec = &ImageRecord{}
+		d.images[name] = rec
+	}
+	return rec
+}
+
+// Seen records that the named image has been used at digest.
+func (d *ImageDigests) Seen(name, digest string) error {
+	d.Lock()
+	defer d.Unlock()
+	rec := d.record(name)
+	for _, seen := range rec.Digests {
+		if seen.Digest == digest {
+			return nil
+		}
+	}
+
+	rec.Digests = append(rec.Digests, ImageDigest{digest, time.Now()})
+	if n := len(rec.Digests); n > imageHistoryLength {
+		rec.Digests = rec.Digests[n-imageHistoryLength:]
+	}
+	return d.history.SaveImage(name, rec)
+}
+
+// Pinned returns the digest the named image is pinned to, if any.
+func (d *ImageDigests) Pinned(name string) string {
+	d.Lock()
+	defer d.Unlock()
+	if rec, ok := d.images[name]; ok {
+		return rec.Pinned
+	}
+	return ""
+}
+
+// Pin uses digest for the named image instead of its latest digest, or goes
+// back to the latest if digest is empty.
+func (d *ImageDigests) Pin(name, digest string) error {
+	d.Lock()
+	defer d.Unlock()
+	rec := d.record(name)
+	rec.Pinned = digest
+	return d.history.SaveImage(name, rec)
+}
+
+// Digests returns the digests the named image has had, newest first.
+func (d *ImageDigests) Digests(name string) (digests []ImageDigest) {
+	d.Lock()
+	defer d.Unlock()
+	if rec, ok := d.images[name]; ok {
+		for i := len(rec.Digests) - 1; i >= 0; i-- {
+			digests = append(digests, rec.Digests[i])
+		}
+	}
+	return
+}
+
+// Find returns the digest the named image has had which matches ref, which
+// may be the whole digest or the start of its hash.
+func (d *ImageDigests) Find(name, ref string) (digest string, err error) {
+	hash := digestHash(ref)
+	if len(hash) < 6 {
+		return "", fmt.Errorf("`%s` is too short to identify a digest", ref)
+	}
+
+	for _, seen := range d.Digests(name) {
+		if seen.Digest != ref && !strings.HasPrefix(digestHash(seen.Digest), hash) {
+			continue
+		}
+		if digest != "" && digest != seen.Digest {
+			return "", fmt.Errorf("`%s` matches more than one digest", ref)
+		}
+		digest = seen.Digest
+	}
+	if digest == "" {
+		err = fmt.Errorf("the %s image hasn't been at `%s` recently", name, ref)
+	}
+	return
+}
+
+// digestHash returns the hash of a digest such as repo@sha256:abc or an image
+// ID such as sha256:abc.
+func digestHash(digest string) string {
+	if i := strings.LastIndex(digest, "@"); i >= 0 {
+		digest = digest[i+1:]
+	}
+	return strings.TrimPrefix(digest, "sha256:")
+}
+
+func processImage(msg *Message, cmd []string, config *Config) {
+	usage := "Use *`image history`*, *`image use <digest>`* or *`image unpin`*, adding the image name after `image` if I have more than one."
+	if config.Current().Executor != "docker" {
+		msg.Reply("I'm not running playbooks from a devops image.")
+		return
+	}
+
+	executors, err := NewExecutors(config)
+	if err != nil {
+		msg.Reply(fmt.Sprintf("I could not create the playbook executor: %s", err))
+		return
+	}
+
+	// Work out which image is meant: it only needs naming if there's more
+	// than one.
+	var name string
+	if len(cmd) > 0 {
+		if _, ok := executors[cmd[0]]; ok {
+			name, cmd = cmd[0], cmd[1:]
+		}
+	}
+	if len(cmd) == 0 {
+		msg.Reply(usage)
+		return
+	}
+	if name == "" {
+		names := executors.Names()
+		if len(names) > 1 {
+			msg.Reply(fmt.Sprintf("Which image do you mean?  I have %s.", strings.Join(names, ", ")))
+			return
+		}
+		name = names[0]
+	}
+
+	switch {
+	case cmd[0] == "history" && len(cmd) == 1:
+		// Make sure the digest in use is recorded.
+		current := executors[name].Digest()
+		digests := config.Digests.Digests(name)
+		if len(digests) == 0 {
+			msg.Reply(fmt.Sprintf("I haven't recorded any digests for the %s image.", name))
+			return
+		}
+
+		reply := fmt.Sprintf("These are the digests the %s image has had, newest first:", name)
+		for _, seen := range digests {
+			reply += fmt.Sprintf("\n  • `%s` first used at %s", seen.Digest, seen.Seen.Format(timeFormat))
+			if seen.Digest == current {
+				reply += " (in use)"
+			}
+		}
+		if pinned := config.Digests.Pinned(name); pinned != "" {
+			reply += fmt.Sprintf("\nIt's pinned to `%s`: use *`image unpin`* to go back to the latest.", pinned)
+		}
+		msg.Reply(reply)
+
+	case cmd[0] == "use" && len(cmd) == 2, cmd[0] == "unpin" && len(cmd) == 1:
+		if !config.AcceptsCommands(msg.ev.Channel) {
+			msg.Reply("I'm sorry, you can only change images on a group channel. This way everyone is notified.")
+			return
+		}
+		if !mayChangeImage(msg, name, config) {
+			return
+		}
+
+		var digest string
+		if cmd[0] == "use" {
+			if digest, err = config.Digests.Find(name, cmd[1]); err != nil {
+				msg.Reply(fmt.Sprintf("I'm sorry, %s.  Use *`image history`* to see the digests I know about.", err))
+				return
+			}
+		}
+		if err = config.Digests.Pin(name, digest); err != nil {
+			msg.Reply(fmt.Sprintf("I'm sorry, I couldn't record that: %s", err))
+			return
+		}
+
+		// Fetch the image if needed and read its playbooks.
+		config.updating.Lock()
+		defer config.updating.Unlock()
+		old := config.Stacks()
+		if _, err = executors[name].Update(msg); err != nil {
+			return
+		}
+		if err = updateConfigFromImage(msg, executors, config); err != nil {
+			return
+		}
+
+		if digest != "" {
+			msg.Reply(fmt.Sprintf("OK, I'll run playbooks from the %s image at `%s` until someone uses *`image unpin`*.", name, digest))
+		} else {
+			msg.Reply(fmt.Sprintf("OK, I'll run playbooks from the latest %s image, now `%s`.", name, executors[name].Digest()))
+		}
+		if changes := describeStackChanges(old, config.Stacks()); changes != "" {
+			msg.Reply("This changes what I can run:" + changes)
+		}
+
+	default:
+		msg.Reply(usage)
+	}
+}
+
+// mayChangeImage returns whether the user may change the digest used for the
+// named image, replying if they can't.  Users may do so if they may run
+// something from every stack in the image.
+func mayChangeImage(msg *Message, name string, config *Config) bool {
+	who := identify(msg, config)
+	if who == nil {
+		return false
+	}
+
+	allowed := make(map[string]bool)
+	for _, stack := range config.Access.Stacks(who, config) {
+		allowed[stack] = true
+	}
+	for stack, st := range config.Stacks() {
+		if st.Image == name && !allowed[stack] {
+			msg.Reply(fmt.Sprintf("I'm sorry, you can only change the %s image if you're allowed to run all of its stacks.", name))
+			return false
+		}
+	}
+	return true
+}
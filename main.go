@@ -11,14 +11,13 @@ import (
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
-	"github.com/nlopes/slack"
 	reaper "github.com/ramr/go-reaper"
 	"github.com/urfave/cli"
 )
 
 var version, commit string
 
-func catchSignals(exit chan<- bool, rtm *slack.RTM, config *Config, logger *log.Logger) {
+func catchSignals(exit chan<- bool, chat Chat, config *Config, logger *log.Logger) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
@@ -35,39 +34,35 @@ func catchSignals(exit chan<- bool, rtm *slack.RTM, config *Config, logger *log.
 			}()
 
 			// Notify the channels I'm a member of that I'm leaving.
-			bc := NewBroadcast(rtm, config.Channels)
-			msg := fmt.Sprintf("I have received the %s signal and am leaving. :anguished:", sig.String())
-			bc.Send(msg)
-
-			// Wait for the received response or timeout.
-			for {
-				select {
-				case evt := <-rtm.IncomingEvents:
-					switch ev := evt.Data.(type) {
-					case *slack.AckMessage:
-						if ev.Text == msg { // The message has been round tripped.
-							logger.Fatalf("exiting after notifying channel of %s signal", sig.String())
-						}
-					}
-				case <-timeout:
-					logger.Fatalf("failed to notify channel about %s signal before timeout", sig.String())
-				}
+			sent := make(chan bool, 1)
+			go func() {
+				bc := NewBroadcast(chat, config.Channels)
+				bc.Send(fmt.Sprintf("I have received the %s signal and am leaving. :anguished:", sig.String()))
+				sent <- true
+			}()
+
+			// Wait for the message to be posted or timeout.
+			select {
+			case <-sent:
+				logger.Fatalf("exiting after notifying channel of %s signal", sig.String())
+			case <-timeout:
+				logger.Fatalf("failed to notify channel about %s signal before timeout", sig.String())
 			}
 		}
 	}()
 }
 
-func UpdateChannels(rtm *slack.RTM, config *Config, logger *log.Logger) (err error) {
+func UpdateChannels(chat Chat, config *Config, logger *log.Logger) (err error) {
 	maxAttempts := config.ConnAttempts
 	for attempts := 1; attempts <= maxAttempts; attempts++ {
-		if err = updateChannels(rtm, config); err == nil {
+		if err = updateChannels(chat, config); err == nil {
 			break
 		}
 
 		// If it's a temporary network error, try again.
 		if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
 			duration := time.Duration(attempts) * time.Second
-			logger.Printf("network error connecting to slack (attempt %d of %d): trying again in %s", attempts, maxAttempts, duration)
+			logger.Printf("network error connecting to %s (attempt %d of %d): trying again in %s", config.Chat, attempts, maxAttempts, duration)
 			time.Sleep(duration)
 			continue
 		} else {
@@ -79,43 +74,81 @@ func UpdateChannels(rtm *slack.RTM, config *Config, logger *log.Logger) (err err
 }
 
 func run(config *Config, logger *log.Logger) (err error) {
-	api := slack.New(config.SlackToken)
-	slack.SetLogger(logger)
-	api.SetDebug(config.Debug)
+	// Connect to the docker daemon, checking it can be reached if it's
+	// needed straight away.
+	if config.DockerClient, err = NewDockerClient(config.DockerHost); err != nil {
+		err = fmt.Errorf("I couldn't create a client for the docker daemon at %s: %s", config.DockerHost.Endpoint(), err)
+		return
+	}
+	if config.Executor == "docker" {
+		if err = config.DockerClient.Ping(); err != nil {
+			err = fmt.Errorf("I couldn't connect to the docker daemon at %s: %s", config.DockerHost.Endpoint(), err)
+			return
+		}
+	}
 
-	// Obtain a handle on the Slack Real Time Messaging API.
-	rtm := api.NewRTM()
-	go rtm.ManageConnection()
+	// Obtain a handle on the chat platform.
+	chat, err := NewChat(config, logger)
+	if err != nil {
+		return
+	}
+	chat.Connect()
+
+	// Open the run history, which also records the devops image digests.
+	var history *History
+	if config.HistoryPath != "" {
+		if history, err = OpenHistory(config.HistoryPath); err != nil {
+			err = fmt.Errorf("I couldn't open my run history: %s", err)
+			return
+		}
+		defer history.Close()
+	}
+	if config.Digests, err = NewImageDigests(history); err != nil {
+		err = fmt.Errorf("I couldn't read the image digests from my run history: %s", err)
+		return
+	}
+
+	// Apply the access rules, and keep the configuration file up to date.
+	config.Access = NewAccess(chat, config.AccessRules)
+	config.Freezes = NewFreezes()
+	if config.File != "" {
+		go watchConfigFile(chat, config, logger)
+	}
 
 	// Set the state to check which deployments are ongoing.
-	state := NewRunState()
+	state := NewRunState(history)
 
-	if err = UpdateChannels(rtm, config, logger); err != nil {
+	if config.APIListen != "" {
+		go ServeAPI(chat, state, config, logger)
+	}
+	if config.MetricsListen != "" {
+		go ServeMetrics(state, config, logger)
+	}
+	go runScheduler(chat, state, config, logger)
+	go pollImages(chat, config, logger)
+
+	if err = UpdateChannels(chat, config, logger); err != nil {
 		err = errors.New(fmt.Sprintf("I couldn't set my channel membership: %s", err))
 		return
 	}
 
 	// Respond to signals.
 	exit := make(chan bool, 1)
-	go catchSignals(exit, rtm, config, logger)
+	go catchSignals(exit, chat, config, logger)
 
 	// The main event loop.
 	var lurch *User
 Loop:
 	for {
 		select {
-		case msg := <-rtm.IncomingEvents:
-			switch ev := msg.Data.(type) {
-			case *slack.HelloEvent:
-				// Ignore hello
-
-			case *slack.ConnectedEvent:
-				//fmt.Println("Infos:", ev.Info)
-				//fmt.Println("Connection counter:", ev.ConnectionCount)
-				lurch = NewUser(ev.Info.User)
-				processConnectedEvent(rtm, config)
-
-			case *slack.DisconnectedEvent:
+		case evt := <-chat.Events():
+			observeConnection(evt)
+			switch ev := evt.(type) {
+			case *ChatConnectedEvent:
+				lurch = ev.User
+				processConnectedEvent(chat, config)
+
+			case *ChatDisconnectedEvent:
 				var msg string
 				if ev.Intentional {
 					msg = "sent away"
@@ -124,29 +157,24 @@ Loop:
 				}
 				logger.Printf(msg)
 
-			case *slack.MessageEvent:
-				go processMessage(rtm, ev, lurch, state, config, logger)
+			case *ChatMessageEvent:
+				go processMessage(chat, ev, lurch, state, config, logger)
 
-			case *slack.RTMError:
-				logger.Printf("error: %s\n", ev.Error())
+			case *ChatCommandEvent:
+				go processCommand(NewCommandMessage(chat, &ev.ChatMessageEvent), state, config, logger)
 
-			case *slack.InvalidAuthEvent:
+			case *ChatErrorEvent:
+				logger.Printf("error: %s\n", ev.Err)
+
+			case *ChatInvalidAuthEvent:
 				logger.Print("invalid credentials")
 				break Loop
 
-			case *slack.GroupLeftEvent:
-				config.Channels.RemoveChannel(ev.Channel)
-			case *slack.ChannelLeftEvent:
+			case *ChatLeftEvent:
 				config.Channels.RemoveChannel(ev.Channel)
 
-			case *slack.GroupJoinedEvent:
-				config.Channels.AddChannel(ev.Channel.ID, Group)
-			case *slack.ChannelJoinedEvent:
-				config.Channels.AddChannel(ev.Channel.ID, Channel)
-
-			default:
-				// Ignore other events...
-				//fmt.Printf("Unexpected: %v\n", msg.Data)
+			case *ChatJoinedEvent:
+				config.Channels.AddChannel(ev.Channel, ev.Type)
 			}
 		case <-exit:
 			// The application is exiting.
@@ -184,12 +212,70 @@ func main() {
 	app.Usage = "the Lurch Slack bot."
 
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:        "chat",
+			Usage:       "the chat platform to connect to: slack or mattermost",
+			EnvVar:      "LURCH_CHAT",
+			Value:       "slack",
+			Destination: &config.Chat,
+		},
 		cli.StringFlag{
 			Name:        "slack-token",
 			Usage:       "your Slack API token",
 			EnvVar:      "LURCH_SLACK_TOKEN",
 			Destination: &config.SlackToken,
 		},
+		cli.StringFlag{
+			Name:        "slack-signing-secret",
+			Usage:       "the signing secret of your Slack app, which enables buttons when the API is served",
+			EnvVar:      "LURCH_SLACK_SIGNING_SECRET",
+			Destination: &config.SlackSecret,
+		},
+		cli.StringFlag{
+			Name:        "mattermost-url",
+			Usage:       "the URL of your Mattermost server",
+			EnvVar:      "LURCH_MATTERMOST_URL",
+			Destination: &config.Mattermost.URL,
+		},
+		cli.StringFlag{
+			Name:        "mattermost-token",
+			Usage:       "your Mattermost bot or personal access token",
+			EnvVar:      "LURCH_MATTERMOST_TOKEN",
+			Destination: &config.Mattermost.Token,
+		},
+		cli.StringFlag{
+			Name:        "executor",
+			Usage:       "how playbooks are run: docker or local",
+			EnvVar:      "LURCH_EXECUTOR",
+			Value:       "docker",
+			Destination: &config.Executor,
+		},
+		cli.StringFlag{
+			Name:        "playbook-dir",
+			Usage:       "the directory containing lurch.yml and your Ansible playbooks when using the local executor",
+			EnvVar:      "LURCH_PLAYBOOK_DIR",
+			Value:       ".",
+			Destination: &config.Local.Dir,
+		},
+		cli.StringFlag{
+			Name:        "docker-host",
+			Usage:       "the docker daemon to run playbooks with",
+			EnvVar:      "LURCH_DOCKER_HOST,DOCKER_HOST",
+			Value:       defaultDockerHost,
+			Destination: &config.DockerHost.Host,
+		},
+		cli.BoolFlag{
+			Name:        "docker-tls-verify",
+			Usage:       "use TLS and verify the docker daemon's certificate",
+			EnvVar:      "LURCH_DOCKER_TLS_VERIFY,DOCKER_TLS_VERIFY",
+			Destination: &config.DockerHost.TLSVerify,
+		},
+		cli.StringFlag{
+			Name:        "docker-cert-path",
+			Usage:       "the directory containing ca.pem, cert.pem and key.pem for TLS (default: ~/.docker)",
+			EnvVar:      "LURCH_DOCKER_CERT_PATH,DOCKER_CERT_PATH",
+			Destination: &config.DockerHost.CertPath,
+		},
 		cli.StringFlag{
 			Name:   "docker-image",
 			Usage:  "the docker image containing your Ansible playbooks",
@@ -201,6 +287,13 @@ func main() {
 			EnvVar:      "LURCH_DISABLE_PULL",
 			Destination: &config.DisablePull,
 		},
+		cli.DurationFlag{
+			Name:        "poll-interval",
+			Usage:       "how often to check the registry for newer versions of the docker images; 0 means only when connecting to chat",
+			EnvVar:      "LURCH_POLL_INTERVAL",
+			Value:       5 * time.Minute,
+			Destination: &config.PollInterval,
+		},
 		cli.BoolFlag{
 			Name:        "enable-dm",
 			Usage:       "run playbooks over direct message channels.",
@@ -231,6 +324,68 @@ func main() {
 			EnvVar:      "LURCH_REGISTRY_ADDRESS",
 			Destination: &config.Docker.Auth.ServerAddress,
 		},
+		cli.StringFlag{
+			Name:        "history",
+			Usage:       "the file in which to record the history of runs; set it to an empty string to disable the history",
+			EnvVar:      "LURCH_HISTORY",
+			Value:       "lurch.db",
+			Destination: &config.HistoryPath,
+		},
+		cli.DurationFlag{
+			Name:        "run-timeout",
+			Usage:       "stop playbooks that run for longer than this (e.g. 1h30m) unless they set their own timeout; 0 means no limit",
+			EnvVar:      "LURCH_RUN_TIMEOUT",
+			Destination: &config.RunTimeout,
+		},
+		cli.StringFlag{
+			Name:        "upload-output",
+			Usage:       "when to attach the output of a run to its thread as a file: failed, always or never",
+			Value:       "failed",
+			EnvVar:      "LURCH_UPLOAD_OUTPUT",
+			Destination: &config.UploadOutput,
+		},
+		cli.DurationFlag{
+			Name:        "approval-timeout",
+			Usage:       "drop runs that need approval if they aren't approved within this time; 0 means they wait indefinitely",
+			EnvVar:      "LURCH_APPROVAL_TIMEOUT",
+			Value:       time.Hour,
+			Destination: &config.ApprovalTimeout,
+		},
+		cli.StringFlag{
+			Name:        "api-listen",
+			Usage:       "the address (e.g. :8080) on which to serve the HTTP API; the API is disabled if this is not set",
+			EnvVar:      "LURCH_API_LISTEN",
+			Destination: &config.APIListen,
+		},
+		cli.StringFlag{
+			Name:        "metrics-listen",
+			Usage:       "the address (e.g. :9090) on which to serve Prometheus metrics at /metrics; metrics are disabled if this is not set",
+			EnvVar:      "LURCH_METRICS_LISTEN",
+			Destination: &config.MetricsListen,
+		},
+		cli.StringFlag{
+			Name:   "api-token",
+			Usage:  "a token that API clients must present, known to the access rules as api:api",
+			EnvVar: "LURCH_API_TOKEN",
+		},
+		cli.StringFlag{
+			Name:        "api-channel",
+			Usage:       "the channel in which to announce runs requested via the API",
+			EnvVar:      "LURCH_API_CHANNEL",
+			Destination: &config.API.Channel,
+		},
+		cli.StringFlag{
+			Name:        "registry-webhook-secret",
+			Usage:       "the secret registries must present to the webhook announcing pushed images, which is served with the API when this is set",
+			EnvVar:      "LURCH_REGISTRY_WEBHOOK_SECRET",
+			Destination: &config.WebhookSecret,
+		},
+		cli.StringFlag{
+			Name:        "config",
+			Usage:       "a YAML file containing further configuration, including access rules; this overrides the command line and is reloaded when it changes",
+			EnvVar:      "LURCH_CONFIG",
+			Destination: &config.File,
+		},
 		cli.BoolFlag{
 			Name:        "debug",
 			Usage:       "produce debugging output",
@@ -239,7 +394,7 @@ func main() {
 		},
 		cli.IntFlag{
 			Name:        "conn-attempts",
-			Usage:       "the maximum number of attempts to be made to connect to Slack on startup",
+			Usage:       "the maximum number of attempts to be made to connect to the chat platform on startup",
 			EnvVar:      "LURCH_CONN_ATTEMPTS",
 			Value:       20,
 			Destination: &config.ConnAttempts,
@@ -249,18 +404,47 @@ func main() {
 	app.Action = func(c *cli.Context) (err error) {
 		logger := log.New(os.Stdout, fmt.Sprintf("%s: ", config.BotName), log.Lshortfile|log.LstdFlags)
 
-		if config.SlackToken == "" {
-			err = errors.New("no slack token is provided")
+		if image := c.String("docker-image"); image != "" {
+			config.Docker.Image, config.Docker.Tag = docker.ParseRepositoryTag(image)
+		}
+		if token := c.String("api-token"); token != "" {
+			config.API.Tokens = map[string]string{"api": token}
+		}
+
+		// Apply the configuration file on top of the command line.
+		config.flags = config.Settings
+		if config.File != "" {
+			var f *ConfigFile
+			if f, err = LoadConfigFile(config.File); err != nil {
+				logger.Printf("I couldn't read my configuration from %s: %s", config.File, err)
+				return
+			}
+			f.ApplyStartup(&config)
+			f.ApplySettings(&config.Settings)
+		}
+
+		switch config.Chat {
+		case "slack":
+			if config.SlackToken == "" {
+				err = errors.New("no slack token is provided")
+			}
+		case "mattermost":
+			if config.Mattermost.URL == "" {
+				err = errors.New("no mattermost url is provided")
+			} else if config.Mattermost.Token == "" {
+				err = errors.New("no mattermost token is provided")
+			}
+		default:
+			err = fmt.Errorf("unknown chat platform: %s", config.Chat)
+		}
+		if err != nil {
 			logger.Println(err)
 			return
 		}
 
-		if image := c.String("docker-image"); image == "" {
-			err = errors.New("no docker image is provided")
+		if err = config.Settings.Validate(); err != nil {
 			logger.Println(err)
 			return
-		} else {
-			config.Docker.Image, config.Docker.Tag = docker.ParseRepositoryTag(image)
 		}
 
 		if err = run(&config, logger); err != nil {
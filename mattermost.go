@@ -0,0 +1,420 @@
+package main
+
+// This provides the Mattermost implementation of the Chat interface using the
+// Mattermost v4 REST and websocket APIs.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+type MattermostChat struct {
+	sync.Mutex
+	url    *url.URL
+	token  string
+	client *http.Client
+	logger *log.Logger
+	events chan interface{}
+	user   *User // The user Lurch is connected as, guarded by the mutex.
+}
+
+func NewMattermostChat(rawurl, token string, logger *log.Logger) (*MattermostChat, error) {
+	u, err := url.Parse(strings.TrimSuffix(rawurl, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("the mattermost url must be http or https: %s", rawurl)
+	}
+
+	return &MattermostChat{
+		url:    u,
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+		logger: logger,
+		events: make(chan interface{}),
+	}, nil
+}
+
+// mattermostError is returned when the REST API responds with an error.
+type mattermostError struct {
+	StatusCode int    `json:"status_code"`
+	Message    string `json:"message"`
+}
+
+func (e *mattermostError) Error() string {
+	return fmt.Sprintf("mattermost responded with %d: %s", e.StatusCode, e.Message)
+}
+
+type mattermostUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+type mattermostTeam struct {
+	ID string `json:"id"`
+}
+
+type mattermostChannel struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+type mattermostGroup struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type mattermostPost struct {
+	ID        string   `json:"id,omitempty"`
+	ChannelID string   `json:"channel_id"`
+	UserID    string   `json:"user_id,omitempty"`
+	RootID    string   `json:"root_id,omitempty"`
+	Message   string   `json:"message"`
+	Type      string   `json:"type,omitempty"`
+	FileIDs   []string `json:"file_ids,omitempty"`
+}
+
+type mattermostFileInfo struct {
+	ID string `json:"id"`
+}
+
+type mattermostEvent struct {
+	Event     string                 `json:"event"`
+	Data      map[string]interface{} `json:"data"`
+	Broadcast struct {
+		ChannelID string `json:"channel_id"`
+		UserID    string `json:"user_id"`
+	} `json:"broadcast"`
+}
+
+// String returns the string value of key in the event data.
+func (e *mattermostEvent) String(key string) string {
+	s, _ := e.Data[key].(string)
+	return s
+}
+
+// api performs a REST request against the Mattermost server, encoding in as
+// the JSON request body and decoding the JSON response into out.
+func (m *MattermostChat) api(method, path string, in, out interface{}) (err error) {
+	var body io.Reader
+	if in != nil {
+		var b []byte
+		if b, err = json.Marshal(in); err != nil {
+			return
+		}
+		body = bytes.NewReader(b)
+	}
+	return m.request(method, path, "application/json", body, out)
+}
+
+// request makes an API request with a body of the given content type,
+// decoding the JSON response into out.
+func (m *MattermostChat) request(method, path, contentType string, body io.Reader, out interface{}) (err error) {
+	var req *http.Request
+	if req, err = http.NewRequest(method, m.url.String()+"/api/v4"+path, body); err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	req.Header.Set("Content-Type", contentType)
+
+	var resp *http.Response
+	if resp, err = m.client.Do(req); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		merr := &mattermostError{StatusCode: resp.StatusCode}
+		if json.NewDecoder(resp.Body).Decode(merr) != nil || merr.Message == "" {
+			merr.Message = resp.Status
+		}
+		return merr
+	}
+
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+	}
+	return
+}
+
+// me returns the user Lurch is connected as.
+func (m *MattermostChat) me() *User {
+	m.Lock()
+	defer m.Unlock()
+	return m.user
+}
+
+// Connect implements the Chat interface.
+func (m *MattermostChat) Connect() {
+	go m.manageConnection()
+}
+
+// Events implements the Chat interface.
+func (m *MattermostChat) Events() <-chan interface{} {
+	return m.events
+}
+
+// Post implements the Chat interface.
+func (m *MattermostChat) Post(id, text string) error {
+	return m.api("POST", "/posts", &mattermostPost{ChannelID: id, Message: text}, nil)
+}
+
+// PostThread implements the Chat interface.
+func (m *MattermostChat) PostThread(id, thread, text string) (string, error) {
+	var post mattermostPost
+	err := m.api("POST", "/posts", &mattermostPost{ChannelID: id, RootID: thread, Message: text}, &post)
+	return post.ID, err
+}
+
+// Update implements the Chat interface.
+func (m *MattermostChat) Update(id, msgID, text string) error {
+	return m.api("PUT", fmt.Sprintf("/posts/%s/patch", msgID), map[string]string{"message": text}, nil)
+}
+
+// PostButtons implements the Chat interface.  The commands are listed after
+// text as Lurch doesn't receive Mattermost button presses.
+func (m *MattermostChat) PostButtons(id, thread, text string, buttons []Button) (string, error) {
+	return m.PostThread(id, thread, ButtonCommands(text, buttons))
+}
+
+// Upload implements the Chat interface.  The file is posted to the thread with
+// title as its message.
+func (m *MattermostChat) Upload(id, thread, filename, title string, content []byte) (err error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err = w.WriteField("channel_id", id); err != nil {
+		return
+	}
+	part, err := w.CreateFormFile("files", filename)
+	if err != nil {
+		return
+	}
+	if _, err = part.Write(content); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+
+	var uploaded struct {
+		FileInfos []mattermostFileInfo `json:"file_infos"`
+	}
+	if err = m.request("POST", "/files", w.FormDataContentType(), &body, &uploaded); err != nil {
+		return
+	}
+
+	post := &mattermostPost{ChannelID: id, RootID: thread, Message: title}
+	for _, info := range uploaded.FileInfos {
+		post.FileIDs = append(post.FileIDs, info.ID)
+	}
+	return m.api("POST", "/posts", post, nil)
+}
+
+// Channels implements the Chat interface.
+func (m *MattermostChat) Channels() (*Channels, error) {
+	var teams []mattermostTeam
+	if err := m.api("GET", "/users/me/teams", nil, &teams); err != nil {
+		return nil, err
+	}
+
+	channels := NewChannels()
+	for _, team := range teams {
+		var chans []mattermostChannel
+		if err := m.api("GET", fmt.Sprintf("/users/me/teams/%s/channels", team.ID), nil, &chans); err != nil {
+			return nil, err
+		}
+		for _, c := range chans {
+			if t := mattermostChannelType(c.Type); t != None {
+				channels.Names[c.ID] = t
+			}
+		}
+	}
+
+	return channels, nil
+}
+
+// UserID implements the Chat interface.
+func (m *MattermostChat) UserID(name string) (string, error) {
+	var user mattermostUser
+	if err := m.api("GET", "/users/username/"+url.PathEscape(name), nil, &user); err != nil {
+		if merr, ok := err.(*mattermostError); ok && merr.StatusCode == http.StatusNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	return user.ID, nil
+}
+
+// GroupMembers implements the Chat interface.  Groups are Mattermost user
+// groups, looked up by name.
+func (m *MattermostChat) GroupMembers(group string) ([]string, error) {
+	var groups []mattermostGroup
+	if err := m.api("GET", "/groups?per_page=200&q="+url.QueryEscape(group), nil, &groups); err != nil {
+		return nil, err
+	}
+
+	for _, g := range groups {
+		if g.ID != group && g.Name != group {
+			continue
+		}
+
+		var members struct {
+			Members []mattermostUser `json:"members"`
+		}
+		if err := m.api("GET", fmt.Sprintf("/groups/%s/members?per_page=1000", g.ID), nil, &members); err != nil {
+			return nil, err
+		}
+
+		ids := make([]string, len(members.Members))
+		for i, user := range members.Members {
+			ids[i] = user.ID
+		}
+		return ids, nil
+	}
+
+	return nil, fmt.Errorf("there's no user group called %s", group)
+}
+
+// mattermostChannelType maps Mattermost channel types to those used by Lurch.
+// Direct and group messages are not considered channels.
+func mattermostChannelType(t string) ChannelType {
+	switch t {
+	case "O":
+		return Channel
+	case "P":
+		return Group
+	}
+	return None
+}
+
+// manageConnection keeps the websocket connection alive, reconnecting with an
+// increasing delay whenever it drops.
+func (m *MattermostChat) manageConnection() {
+	var attempts int
+	for {
+		connected, err := m.connect()
+		if merr, ok := err.(*mattermostError); ok && merr.StatusCode == http.StatusUnauthorized {
+			m.events <- &ChatInvalidAuthEvent{}
+			return
+		}
+
+		if connected {
+			attempts = 0
+			m.events <- &ChatDisconnectedEvent{false}
+		}
+		m.events <- &ChatErrorEvent{err}
+
+		attempts++
+		delay := time.Duration(attempts) * time.Second
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+		m.logger.Printf("reconnecting to mattermost in %s", delay)
+		time.Sleep(delay)
+	}
+}
+
+// connect dials the websocket and dispatches events until the connection is
+// lost, returning whether the connection was ever established.
+func (m *MattermostChat) connect() (connected bool, err error) {
+	var me mattermostUser
+	if err = m.api("GET", "/users/me", nil, &me); err != nil {
+		return
+	}
+	user := NewUser(me.ID, me.Username, "@"+me.Username)
+	m.Lock()
+	m.user = user
+	m.Unlock()
+
+	wsURL := *m.url
+	if wsURL.Scheme == "https" {
+		wsURL.Scheme = "wss"
+	} else {
+		wsURL.Scheme = "ws"
+	}
+	wsURL.Path += "/api/v4/websocket"
+
+	var cfg *websocket.Config
+	if cfg, err = websocket.NewConfig(wsURL.String(), m.url.String()); err != nil {
+		return
+	}
+	cfg.Header.Set("Authorization", "Bearer "+m.token)
+
+	var ws *websocket.Conn
+	if ws, err = websocket.DialConfig(cfg); err != nil {
+		return
+	}
+	defer ws.Close()
+
+	connected = true
+	m.events <- &ChatConnectedEvent{user}
+
+	for {
+		var ev mattermostEvent
+		if err = websocket.JSON.Receive(ws, &ev); err != nil {
+			return
+		}
+		m.dispatch(&ev)
+	}
+}
+
+// dispatch converts a Mattermost websocket event into a chat event.
+func (m *MattermostChat) dispatch(ev *mattermostEvent) {
+	switch ev.Event {
+	case "posted":
+		var post mattermostPost
+		if err := json.Unmarshal([]byte(ev.String("post")), &post); err != nil {
+			m.events <- &ChatErrorEvent{err}
+			return
+		}
+		if post.Type != "" {
+			return // Ignore system messages.
+		}
+
+		// Replies must be made to the root of a thread.
+		thread := post.RootID
+		if thread == "" {
+			thread = post.ID
+		}
+
+		m.events <- &ChatMessageEvent{
+			Channel:     post.ChannelID,
+			User:        post.UserID,
+			UserMention: "@" + strings.TrimPrefix(ev.String("sender_name"), "@"),
+			Text:        post.Message,
+			Thread:      thread,
+			Direct:      ev.String("channel_type") == "D",
+		}
+
+	case "user_added":
+		if ev.String("user_id") != m.me().ID {
+			return
+		}
+
+		var channel mattermostChannel
+		if err := m.api("GET", "/channels/"+ev.Broadcast.ChannelID, nil, &channel); err != nil {
+			m.events <- &ChatErrorEvent{err}
+			return
+		}
+		if t := mattermostChannelType(channel.Type); t != None {
+			m.events <- &ChatJoinedEvent{channel.ID, t}
+		}
+
+	case "user_removed":
+		if ev.Broadcast.UserID == m.me().ID {
+			m.events <- &ChatLeftEvent{ev.String("channel_id")}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// fakeMattermost serves enough of the Mattermost API for the bot user
+// "lurch", sending the events it's given over the websocket.
+type fakeMattermost struct {
+	sync.Mutex
+	*httptest.Server
+	events chan *mattermostEvent
+	posts  []mattermostPost
+}
+
+func newFakeMattermost(t *testing.T) *fakeMattermost {
+	f := &fakeMattermost{events: make(chan *mattermostEvent)}
+
+	authorised := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(&mattermostError{http.StatusUnauthorized, "invalid token"})
+				return
+			}
+			h(w, r)
+		}
+	}
+	reply := func(v interface{}) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(v)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/users/me", authorised(reply(&mattermostUser{"bot", "lurch"})))
+	mux.HandleFunc("/api/v4/users/username/alice", authorised(reply(&mattermostUser{"U1", "alice"})))
+	mux.HandleFunc("/api/v4/users/username/", authorised(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&mattermostError{http.StatusNotFound, "no such user"})
+	}))
+	mux.HandleFunc("/api/v4/channels/C2", authorised(reply(&mattermostChannel{"C2", "P"})))
+	mux.HandleFunc("/api/v4/posts", authorised(func(w http.ResponseWriter, r *http.Request) {
+		var post mattermostPost
+		if r.Method != "POST" || json.NewDecoder(r.Body).Decode(&post) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.Lock()
+		f.posts = append(f.posts, post)
+		f.Unlock()
+		post.ID = "P1"
+		json.NewEncoder(w).Encode(&post)
+	}))
+	mux.HandleFunc("/api/v4/websocket", authorised(websocket.Handler(func(ws *websocket.Conn) {
+		for ev := range f.events {
+			if err := websocket.JSON.Send(ws, ev); err != nil {
+				t.Errorf("couldn't send an event: %s", err)
+				return
+			}
+		}
+	}).ServeHTTP))
+
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// Close stops the websocket and the server.
+func (f *fakeMattermost) Close() {
+	close(f.events)
+	f.Server.Close()
+}
+
+// posted returns a posted event for post.
+func posted(post mattermostPost, sender, channelType string) *mattermostEvent {
+	b, _ := json.Marshal(&post)
+	return &mattermostEvent{Event: "posted", Data: map[string]interface{}{
+		"post":         string(b),
+		"sender_name":  sender,
+		"channel_type": channelType,
+	}}
+}
+
+// nextEvent returns the next event from chat.
+func nextEvent(t *testing.T, chat Chat) interface{} {
+	select {
+	case ev := <-chat.Events():
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return nil
+}
+
+// connectMattermost connects to the fake server, returning the bot user.
+func connectMattermost(t *testing.T, f *fakeMattermost, token string) (*MattermostChat, *User) {
+	chat, err := NewMattermostChat(f.URL+"/", token, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chat.Connect()
+
+	switch ev := nextEvent(t, chat).(type) {
+	case *ChatConnectedEvent:
+		return chat, ev.User
+	case *ChatInvalidAuthEvent:
+		return chat, nil
+	default:
+		t.Fatalf("expected to connect, got %#v", ev)
+	}
+	return nil, nil
+}
+
+func TestMattermostMessages(t *testing.T) {
+	f := newFakeMattermost(t)
+	defer f.Close()
+
+	chat, user := connectMattermost(t, f, "token")
+	if user == nil || user.ID != "bot" || user.Name != "lurch" || user.Mention != "@lurch" {
+		t.Fatalf("connected as the wrong user: %#v", user)
+	}
+
+	tests := []struct {
+		name  string
+		event *mattermostEvent
+		ev    ChatMessageEvent
+		text  *string // What NewMessage makes of it, nil if it's ignored.
+	}{
+		{
+			"mention",
+			posted(mattermostPost{ID: "M1", ChannelID: "C1", UserID: "U1", Message: "@lurch: list website"}, "@alice", "O"),
+			ChatMessageEvent{Channel: "C1", User: "U1", UserMention: "@alice", Text: "@lurch: list website", Thread: "M1"},
+			stringPtr("list website"),
+		},
+		{
+			"mention in a thread",
+			posted(mattermostPost{ID: "M2", ChannelID: "C1", UserID: "U1", RootID: "M1", Message: "thanks @lurch"}, "alice", "P"),
+			ChatMessageEvent{Channel: "C1", User: "U1", UserMention: "@alice", Text: "thanks @lurch", Thread: "M1"},
+			stringPtr(""),
+		},
+		{
+			"no mention",
+			posted(mattermostPost{ID: "M3", ChannelID: "C1", UserID: "U1", Message: "list website"}, "@alice", "O"),
+			ChatMessageEvent{Channel: "C1", User: "U1", UserMention: "@alice", Text: "list website", Thread: "M3"},
+			nil,
+		},
+		{
+			"direct message",
+			posted(mattermostPost{ID: "M4", ChannelID: "D1", UserID: "U1", Message: "status"}, "@alice", "D"),
+			ChatMessageEvent{Channel: "D1", User: "U1", UserMention: "@alice", Text: "status", Thread: "M4", Direct: true},
+			stringPtr("status"),
+		},
+		{
+			"own message",
+			posted(mattermostPost{ID: "M5", ChannelID: "D1", UserID: "bot", Message: "Hello"}, "@lurch", "D"),
+			ChatMessageEvent{Channel: "D1", User: "bot", UserMention: "@lurch", Text: "Hello", Thread: "M5", Direct: true},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		// System messages should be skipped.
+		f.events <- posted(mattermostPost{ID: "S1", ChannelID: "C1", Type: "system_join_channel"}, "@alice", "O")
+		f.events <- test.event
+
+		ev, ok := nextEvent(t, chat).(*ChatMessageEvent)
+		if !ok {
+			t.Fatalf("%s: expected a message, got %#v", test.name, ev)
+		}
+		if *ev != test.ev {
+			t.Errorf("%s: expected %#v, got %#v", test.name, test.ev, *ev)
+		}
+
+		msg := NewMessage(chat, ev, user)
+		if test.text == nil && msg != nil {
+			t.Errorf("%s: expected the message to be ignored, got %q", test.name, msg.Text)
+		} else if test.text != nil && (msg == nil || msg.Text != *test.text) {
+			t.Errorf("%s: expected the message %q, got %#v", test.name, *test.text, msg)
+		}
+	}
+
+	joined := &mattermostEvent{Event: "user_added", Data: map[string]interface{}{"user_id": "bot"}}
+	joined.Broadcast.ChannelID = "C2"
+	f.events <- joined
+	if ev, ok := nextEvent(t, chat).(*ChatJoinedEvent); !ok || *ev != (ChatJoinedEvent{"C2", Group}) {
+		t.Errorf("expected to join C2, got %#v", ev)
+	}
+
+	left := &mattermostEvent{Event: "user_removed", Data: map[string]interface{}{"channel_id": "C2"}}
+	left.Broadcast.UserID = "bot"
+	f.events <- left
+	if ev, ok := nextEvent(t, chat).(*ChatLeftEvent); !ok || ev.Channel != "C2" {
+		t.Errorf("expected to leave C2, got %#v", ev)
+	}
+}
+
+func TestMattermostPosting(t *testing.T) {
+	f := newFakeMattermost(t)
+	defer f.Close()
+	chat, _ := connectMattermost(t, f, "token")
+
+	if err := chat.Post("C1", "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	id, err := chat.PostThread("C1", "M1", "Hello again")
+	if err != nil {
+		t.Fatal(err)
+	} else if id != "P1" {
+		t.Errorf("expected the post ID P1, got %s", id)
+	}
+
+	expected := []mattermostPost{
+		{ChannelID: "C1", Message: "Hello"},
+		{ChannelID: "C1", RootID: "M1", Message: "Hello again"},
+	}
+	f.Lock()
+	defer f.Unlock()
+	if len(f.posts) != len(expected) {
+		t.Fatalf("expected %d posts, got %#v", len(expected), f.posts)
+	}
+	for i, post := range f.posts {
+		if post.ChannelID != expected[i].ChannelID || post.RootID != expected[i].RootID || post.Message != expected[i].Message {
+			t.Errorf("expected %#v, got %#v", expected[i], post)
+		}
+	}
+}
+
+func TestMattermostUserID(t *testing.T) {
+	f := newFakeMattermost(t)
+	defer f.Close()
+	chat, _ := connectMattermost(t, f, "token")
+
+	if id, err := chat.UserID("alice"); err != nil || id != "U1" {
+		t.Errorf("expected alice to be U1, got %q, %v", id, err)
+	}
+	if id, err := chat.UserID("nobody"); err != nil || id != "" {
+		t.Errorf("expected no such user, got %q, %v", id, err)
+	}
+}
+
+func TestMattermostInvalidToken(t *testing.T) {
+	f := newFakeMattermost(t)
+	defer f.Close()
+
+	if _, user := connectMattermost(t, f, "wrong"); user != nil {
+		t.Errorf("connected with an invalid token as %#v", user)
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
@@ -2,55 +2,46 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"strings"
-
-	"github.com/nlopes/slack"
 )
 
 type Message struct {
 	Text string
-	rtm  *slack.RTM
-	ev   *slack.MessageEvent
+	chat Chat
+	ev   *ChatMessageEvent
 }
 
-func NewMessage(rtm *slack.RTM, ev *slack.MessageEvent, user *User) *Message {
-	var prefix, text string
+func NewMessage(chat Chat, ev *ChatMessageEvent, user *User) *Message {
+	var prefix string
+	text := ev.Text
 
 	// Don't respond to myself.
 	if ev.User == user.ID {
 		return nil
 	}
 
-	// Get the message text.
-	if ev.SubMessage != nil && ev.SubType == "message_changed" {
-		text = ev.SubMessage.Text
-	} else if ev.SubType == "" {
-		text = ev.Text
-	} else {
-		return nil
-	}
-
 	// Decide if the message is for us.
 	if strings.HasPrefix(text, user.Name) {
 		var reply string
-		if len(ev.Members) > 2 {
-			reply = fmt.Sprintf("<@%s> are you talking to me?  Please mention me directly as %s.", ev.User, user.Mention)
+		if !ev.Direct {
+			reply = fmt.Sprintf("%s are you talking to me?  Please mention me directly as %s.", ev.UserMention, user.Mention)
 		} else {
 			reply = fmt.Sprintf("As it's just the two of us I assume you're talking to me?  In company you need to mention me directly as %s, but one-to-one you don't need to get my attention: I'll try and respond to everything you say.", user.Mention)
 		}
-		sendMessage(reply, rtm, ev)
+		chat.Post(ev.Channel, reply)
 		return nil
 	} else if strings.HasPrefix(text, user.Mention) {
 		prefix = user.Mention
 	} else if strings.Contains(text, user.Mention) {
 		text = ""
-	} else if len(ev.Members) > 2 {
+	} else if !ev.Direct {
 		return nil // The message isn't for the user.
 	}
 
 	return &Message{
 		Text: strings.Trim(strings.TrimPrefix(text, prefix), ": "),
-		rtm:  rtm,
+		chat: chat,
 		ev:   ev,
 	}
 }
@@ -67,12 +58,8 @@ func (msg *Message) Command() (cmd []string) {
 	return
 }
 
-func sendMessage(msg string, rtm *slack.RTM, ev *slack.MessageEvent) {
-	rtm.SendMessage(rtm.NewOutgoingMessage(msg, ev.Channel))
-}
-
 func (msg *Message) Reply(reply string) {
-	sendMessage(reply, msg.rtm, msg.ev)
+	msg.chat.Post(msg.ev.Channel, reply)
 }
 
 // Send implements the Conversation interface.
@@ -81,38 +68,132 @@ func (msg *Message) Send(message string) error {
 	return nil
 }
 
+// ReplyButtons posts reply with buttons to the channel.
+func (msg *Message) ReplyButtons(reply string, buttons ...Button) {
+	msg.chat.PostButtons(msg.ev.Channel, "", reply, buttons)
+}
+
+// Thread returns the thread msg belongs to.
+func (msg *Message) Thread() *Thread {
+	return NewThread(msg.chat, msg.ev.Channel, msg.ev.Thread)
+}
+
+// NewCommandMessage returns a Message for a command issued other than by
+// messaging Lurch.
+func NewCommandMessage(chat Chat, ev *ChatMessageEvent) *Message {
+	return &Message{Text: ev.Text, chat: chat, ev: ev}
+}
+
+// NewThreadMessage returns a Message for replying in a thread on behalf of
+// user, for runs that weren't requested in chat.
+func NewThreadMessage(chat Chat, channelID, threadID, user, mention string) *Message {
+	return &Message{chat: chat, ev: &ChatMessageEvent{
+		Channel:     channelID,
+		User:        user,
+		UserMention: mention,
+		Thread:      threadID,
+	}}
+}
+
 type Conversation interface {
 	Send(msg string) error
 }
 
 type ChannelMessage struct {
-	rtm       *slack.RTM
+	chat      Chat
 	channelID string
 }
 
-func NewChannelMessage(rtm *slack.RTM, channelID string) *ChannelMessage {
+func NewChannelMessage(chat Chat, channelID string) *ChannelMessage {
 	return &ChannelMessage{
-		rtm:       rtm,
+		chat:      chat,
 		channelID: channelID,
 	}
 }
 
 // Send implements the Conversation interface.
 func (m *ChannelMessage) Send(msg string) error {
-	m.rtm.SendMessage(m.rtm.NewOutgoingMessage(msg, m.channelID))
-	return nil
+	return m.chat.Post(m.channelID, msg)
+}
+
+type Thread struct {
+	chat      Chat
+	channelID string
+	threadID  string
+}
+
+func NewThread(chat Chat, channelID, threadID string) *Thread {
+	return &Thread{
+		chat:      chat,
+		channelID: channelID,
+		threadID:  threadID,
+	}
+}
+
+// Send implements the Conversation interface.
+func (t *Thread) Send(msg string) (err error) {
+	_, err = t.chat.PostThread(t.channelID, t.threadID, msg)
+	return
+}
+
+// Upload attaches content to the thread as a file called filename.
+func (t *Thread) Upload(filename, title string, content []byte) error {
+	return t.chat.Upload(t.channelID, t.threadID, filename, title, content)
+}
+
+// NewStatus returns a Status message within the thread.
+func (t *Thread) NewStatus() *Status {
+	return &Status{thread: t}
+}
+
+// Status is a message in a thread that is edited in place each time it is set.
+type Status struct {
+	thread *Thread
+	id     string // The message ID, once posted.
+}
+
+// Set posts text as the status, replacing any previous text.
+func (s *Status) Set(text string) (err error) {
+	t := s.thread
+	if s.id == "" {
+		s.id, err = t.chat.PostThread(t.channelID, t.threadID, text)
+		return
+	}
+
+	return t.chat.Update(t.channelID, s.id, text)
 }
 
 type Broadcast struct {
-	rtm   *slack.RTM
+	chat  Chat
 	chans *Channels
 }
 
-func NewBroadcast(rtm *slack.RTM, chans *Channels) *Broadcast {
-	return &Broadcast{rtm, chans}
+func NewBroadcast(chat Chat, chans *Channels) *Broadcast {
+	return &Broadcast{chat, chans}
 }
 
-func (b *Broadcast) Send(msg string) error {
-	BroadcastMessage(b.rtm, msg, b.chans.GetChannels())
+// Send implements the Conversation interface.
+func (b *Broadcast) Send(msg string) (err error) {
+	for _, id := range b.chans.GetChannels() {
+		if e := b.chat.Post(id, msg); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// Log is a Conversation written to a log instead of chat, for work done in
+// the background.
+type Log struct {
+	logger *log.Logger
+}
+
+func NewLog(logger *log.Logger) *Log {
+	return &Log{logger}
+}
+
+// Send implements the Conversation interface.
+func (l *Log) Send(msg string) error {
+	l.logger.Print(msg)
 	return nil
 }
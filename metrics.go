@@ -0,0 +1,163 @@
+package main
+
+// This provides Prometheus metrics describing runs, image pulls, the
+// connection to the chat platform and the run queues.
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	runsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lurch_runs_total",
+		Help: "Playbook runs that have finished, by stack, playbook, action and outcome.",
+	}, []string{"stack", "playbook", "action", "outcome"})
+
+	runDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lurch_run_duration_seconds",
+		Help:    "How long playbook runs took.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14), // Up to about 2 hours.
+	}, []string{"stack", "playbook", "action"})
+
+	hostResultsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lurch_host_results_total",
+		Help: "Changed, failed and unreachable task results for each host from finished runs.",
+	}, []string{"stack", "host", "result"})
+
+	imagePullsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lurch_image_pulls_total",
+		Help: "Checks for a newer devops image, by result.",
+	}, []string{"result"})
+
+	imagePullDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lurch_image_pull_duration_seconds",
+		Help:    "How long checks for a newer devops image took.",
+		Buckets: prometheus.ExponentialBuckets(0.25, 2, 12),
+	}, []string{"result"})
+
+	chatConnectsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "lurch_chat_connects_total",
+		Help: "Connections established to the chat platform.",
+	})
+
+	chatDisconnectsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "lurch_chat_disconnects_total",
+		Help: "Disconnections from the chat platform, by whether they were intentional.",
+	}, []string{"intentional"})
+)
+
+func init() {
+	prometheus.MustRegister(runsTotal, runDuration, hostResultsTotal,
+		imagePullsTotal, imagePullDuration, chatConnectsTotal, chatDisconnectsTotal)
+}
+
+// metricsOutcome returns the outcome of rec for use as a label.  Stopped runs
+// are reported by how they were stopped rather than the full reason, which
+// names the user.
+func metricsOutcome(rec *RunRecord) string {
+	switch {
+	case strings.HasPrefix(rec.Stopped, "timed out"):
+		return "timed out"
+	case rec.Stopped != "":
+		return "cancelled"
+	}
+	return rec.Outcome()
+}
+
+// observeRun records the metrics for the finished run rec.
+func observeRun(rec *RunRecord) {
+	runsTotal.WithLabelValues(rec.Stack, rec.Playbook, rec.Action, metricsOutcome(rec)).Inc()
+	runDuration.WithLabelValues(rec.Stack, rec.Playbook, rec.Action).Observe(rec.End.Sub(rec.Start).Seconds())
+
+	if rec.Results == nil {
+		return
+	}
+	for host, stats := range rec.Results.Stats {
+		hostResultsTotal.WithLabelValues(rec.Stack, host, "changed").Add(float64(stats.Changed))
+		hostResultsTotal.WithLabelValues(rec.Stack, host, "failed").Add(float64(stats.Failure))
+		hostResultsTotal.WithLabelValues(rec.Stack, host, "unreachable").Add(float64(stats.Unreachable))
+	}
+}
+
+// observePull records the metrics for a check for a newer image, given
+// whether the image changed.
+func observePull(started time.Time, updated bool, err error) {
+	result := "current"
+	switch {
+	case err != nil:
+		result = "failed"
+	case updated:
+		result = "updated"
+	}
+	imagePullsTotal.WithLabelValues(result).Inc()
+	imagePullDuration.WithLabelValues(result).Observe(time.Since(started).Seconds())
+}
+
+// observeConnection records a connection to or disconnection from the chat
+// platform.
+func observeConnection(evt interface{}) {
+	switch ev := evt.(type) {
+	case *ChatConnectedEvent:
+		chatConnectsTotal.Inc()
+	case *ChatDisconnectedEvent:
+		if ev.Intentional {
+			chatDisconnectsTotal.WithLabelValues("true").Inc()
+		} else {
+			chatDisconnectsTotal.WithLabelValues("false").Inc()
+		}
+	}
+}
+
+// stateCollector reports the occupancy of the run queues when metrics are
+// scraped.
+type stateCollector struct {
+	state   *RunState
+	running *prometheus.Desc
+	queued  *prometheus.Desc
+	pending *prometheus.Desc
+}
+
+func newStateCollector(state *RunState) *stateCollector {
+	return &stateCollector{
+		state:   state,
+		running: prometheus.NewDesc("lurch_stack_locked", "Whether a run holds the stack.", []string{"stack"}, nil),
+		queued:  prometheus.NewDesc("lurch_runs_queued", "Runs waiting for the stack to become free.", []string{"stack"}, nil),
+		pending: prometheus.NewDesc("lurch_runs_pending", "Runs awaiting approval.", nil, nil),
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.running
+	ch <- c.queued
+	ch <- c.pending
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.state.Lock()
+	defer c.state.Unlock()
+	for stack, queue := range c.state.queues {
+		ch <- prometheus.MustNewConstMetric(c.running, prometheus.GaugeValue, 1, stack)
+		ch <- prometheus.MustNewConstMetric(c.queued, prometheus.GaugeValue, float64(len(queue)-1), stack)
+	}
+	ch <- prometheus.MustNewConstMetric(c.pending, prometheus.GaugeValue, float64(len(c.state.pending)))
+}
+
+// ServeMetrics serves the metrics on the address given in config.
+func ServeMetrics(state *RunState, config *Config, logger *log.Logger) {
+	prometheus.MustRegister(newStateCollector(state))
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	logger.Printf("serving metrics on %s", config.MetricsListen)
+	if err := http.ListenAndServe(config.MetricsListen, mux); err != nil {
+		logger.Printf("the metrics server failed: %s", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+// This provides the ansible-playbook options users may pass with a run.
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// RunOptions are the options passed with a run to target a subset of hosts or
+// tasks.  Each is a comma separated list, as accepted by ansible-playbook.
+type RunOptions struct {
+	Limit    string `json:"limit,omitempty"`
+	Tags     string `json:"tags,omitempty"`
+	SkipTags string `json:"skip_tags,omitempty"`
+
+	OverrideFreeze string `json:"override_freeze,omitempty"` // Why the run goes ahead despite a freeze.
+}
+
+// ParseRunOptions separates any options from the words of a command,
+// returning the remaining words.  Options take the form `--name value` or
+// `--name=value` and may be repeated.  The reason given with --override-freeze
+// may be quoted to include spaces.
+func ParseRunOptions(words []string) (rest []string, opts *RunOptions, err error) {
+	opts = &RunOptions{}
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		// Chat clients often turn a double hyphen into an em dash.
+		if strings.HasPrefix(word, "—") {
+			word = "--" + strings.TrimPrefix(word, "—")
+		}
+		if !strings.HasPrefix(word, "--") {
+			rest = append(rest, word)
+			continue
+		}
+
+		name, value := word[2:], ""
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value = name[:j], name[j+1:]
+		} else if i+1 < len(words) {
+			i++
+			value = words[i]
+		}
+		if value == "" {
+			err = fmt.Errorf("`--%s` needs a value", name)
+			return
+		}
+
+		if name == "override-freeze" {
+			if value, i, err = quotedOption(value, words, i); err != nil {
+				return
+			}
+			opts.OverrideFreeze = value
+			continue
+		}
+
+		var opt *string
+		switch name {
+		case "limit":
+			opt = &opts.Limit
+		case "tags":
+			opt = &opts.Tags
+		case "skip-tags":
+			opt = &opts.SkipTags
+		default:
+			err = fmt.Errorf("I don't know the `--%s` option: I only understand `--limit`, `--tags`, `--skip-tags` and `--override-freeze`", name)
+			return
+		}
+		if *opt != "" {
+			*opt += ","
+		}
+		*opt += value
+	}
+
+	return
+}
+
+// quotedOption returns value, extended with the words following index i up to
+// the closing quote if it starts with a quote, and the index of its last word.
+func quotedOption(value string, words []string, i int) (string, int, error) {
+	quote, size := utf8.DecodeRuneInString(value)
+	var closing string
+	switch quote {
+	case '"', '\'':
+		closing = string(quote)
+	case '“': // Chat clients often use curly quotes.
+		closing = "”"
+	case '‘':
+		closing = "’"
+	default:
+		return value, i, nil
+	}
+
+	text := value[size:]
+	for !strings.HasSuffix(text, closing) {
+		if i+1 >= len(words) {
+			return "", i, errors.New("the reason given with `--override-freeze` is missing its closing quote")
+		}
+		i++
+		text += " " + words[i]
+	}
+	return strings.TrimSuffix(text, closing), i, nil
+}
+
+// Check returns an error if the options aren't permitted by pb.
+func (o *RunOptions) Check(pb Playbook) error {
+	if err := checkOption("limit", o.Limit, ",:", pb.Limit); err != nil {
+		return err
+	}
+	if err := checkOption("tags", o.Tags, ",", pb.Tags); err != nil {
+		return err
+	}
+	return checkOption("skip-tags", o.SkipTags, ",", pb.Tags)
+}
+
+// checkOption returns an error if any of the values in the list value, which
+// is split on any of seps, doesn't match one of the allowed patterns.
+func checkOption(name, value, seps string, allowed []string) error {
+	if value == "" {
+		return nil
+	}
+	if len(allowed) == 0 {
+		return fmt.Errorf("the playbook doesn't allow `--%s`", name)
+	}
+
+	values := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(seps, r)
+	})
+Values:
+	for _, v := range values {
+		for _, pattern := range allowed {
+			if ok, _ := path.Match(pattern, v); ok {
+				continue Values
+			}
+		}
+		return fmt.Errorf("the playbook doesn't allow `%s` with `--%s`", v, name)
+	}
+
+	return nil
+}
+
+// Args returns the ansible-playbook arguments for the options.
+func (o *RunOptions) Args() (args []string) {
+	if o.Limit != "" {
+		args = append(args, "--limit", o.Limit)
+	}
+	if o.Tags != "" {
+		args = append(args, "--tags", o.Tags)
+	}
+	if o.SkipTags != "" {
+		args = append(args, "--skip-tags", o.SkipTags)
+	}
+	return
+}
+
+func (o *RunOptions) String() string {
+	return strings.Join(o.Args(), " ")
+}
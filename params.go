@@ -0,0 +1,232 @@
+package main
+
+// This provides typed parameters that users supply when running a playbook.
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// paramName matches the names of parameters given as name=value.
+	paramName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// semverValue matches a semantic version, with an optional leading v.
+	semverValue = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
+	// templateMarkers start Jinja2 expressions, statements and comments, which
+	// Ansible would evaluate in values passed as extra vars.
+	templateMarkers = []string{"{{", "{%", "{#"}
+)
+
+// Param declares a parameter for a playbook or action.
+type Param struct {
+	Type     string   `yaml:"type,omitempty" json:"type,omitempty"` // One of string (the default), int, bool, enum, semver or regex.
+	Default  string   `yaml:"default,omitempty" json:"default,omitempty"`
+	Required bool     `yaml:"required,omitempty" json:"required,omitempty"`
+	About    string   `yaml:"about,omitempty" json:"about,omitempty"`
+	Values   []string `yaml:"values,omitempty" json:"values,omitempty"`   // The values allowed for an enum.
+	Pattern  string   `yaml:"pattern,omitempty" json:"pattern,omitempty"` // The expression a regex value must match.
+
+	re *regexp.Regexp // Pattern, compiled by checkParams.
+}
+
+// compile compiles the pattern of a regex parameter.
+func (p *Param) compile(name string) (err error) {
+	if p.Type == "regex" {
+		if p.re, err = regexp.Compile("^(?:" + p.Pattern + ")$"); err != nil {
+			err = fmt.Errorf("the pattern for `%s` is invalid: %s", name, err)
+		}
+	}
+	return
+}
+
+// checkParams compiles the patterns of the regex parameters in stacks,
+// returning an error if any is invalid.
+func checkParams(stacks map[string]Stack) error {
+	check := func(params map[string]Param, stack, playbook string) error {
+		for name, param := range params {
+			if err := param.compile(name); err != nil {
+				return fmt.Errorf("*%s %s*: %s", stack, playbook, err)
+			}
+			params[name] = param
+		}
+		return nil
+	}
+
+	for stack, st := range stacks {
+		for playbook, pb := range st.Playbooks {
+			if err := check(pb.Params, stack, playbook); err != nil {
+				return err
+			}
+			for _, action := range pb.Actions {
+				if err := check(action.Params, stack, playbook); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Parse converts value to the parameter's type, returning an error if it isn't
+// valid.
+func (p Param) Parse(name, value string) (interface{}, error) {
+	switch p.Type {
+	case "", "string":
+		return value, nil
+	case "int":
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("`%s` must be a whole number", name)
+		}
+		return i, nil
+	case "bool":
+		switch strings.ToLower(value) {
+		case "true", "yes", "on", "1":
+			return true, nil
+		case "false", "no", "off", "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("`%s` must be true or false", name)
+	case "enum":
+		for _, v := range p.Values {
+			if v == value {
+				return value, nil
+			}
+		}
+		return nil, fmt.Errorf("`%s` must be one of %s", name, strings.Join(p.Values, ", "))
+	case "semver":
+		if !semverValue.MatchString(value) {
+			return nil, fmt.Errorf("`%s` must be a version number such as 1.4.2", name)
+		}
+		return value, nil
+	case "regex":
+		if p.re == nil {
+			if err := p.compile(name); err != nil {
+				return nil, err
+			}
+		}
+		if !p.re.MatchString(value) {
+			return nil, fmt.Errorf("`%s` must match `%s`", name, p.Pattern)
+		}
+		return value, nil
+	}
+
+	return nil, fmt.Errorf("`%s` has an unknown type: %s", name, p.Type)
+}
+
+// describe summarises the parameter for users.
+func (p Param) describe(name string) (text string) {
+	var details []string
+	switch p.Type {
+	case "", "string":
+		details = append(details, "text")
+	case "enum":
+		details = append(details, "one of "+strings.Join(p.Values, ", "))
+	case "regex":
+		details = append(details, fmt.Sprintf("matching `%s`", p.Pattern))
+	case "semver":
+		details = append(details, "a version")
+	default:
+		details = append(details, p.Type)
+	}
+	if p.Required {
+		details = append(details, "required")
+	}
+	if p.Default != "" {
+		details = append(details, fmt.Sprintf("default `%s`", p.Default))
+	}
+
+	text = fmt.Sprintf("`%s` (%s)", name, strings.Join(details, ", "))
+	if p.About != "" {
+		text += ": " + Desentence(p.About)
+	}
+	return
+}
+
+// DescribeParams lists params for users, one per line with the given indent.
+func DescribeParams(params map[string]Param, indent string) (text string) {
+	var names []string
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		text += fmt.Sprintf("\n%s• %s", indent, params[name].describe(name))
+	}
+	return
+}
+
+// ParseParams separates parameters given as name=value from the words of a
+// command, returning the remaining words.
+func ParseParams(words []string) (rest []string, values map[string]string) {
+	values = make(map[string]string)
+	for _, word := range words {
+		if i := strings.Index(word, "="); i > 0 && paramName.MatchString(word[:i]) {
+			values[word[:i]] = word[i+1:]
+		} else {
+			rest = append(rest, word)
+		}
+	}
+	return
+}
+
+// ResolveParams validates the values given for the declared params, filling
+// in defaults.  Given values may not contain templates, which Ansible would
+// otherwise evaluate.  It returns the values as strings for reporting to users, and as
+// a JSON object suitable for --extra-vars, which is empty if there are no
+// params.
+func ResolveParams(declared map[string]Param, given map[string]string) (values map[string]string, vars string, err error) {
+	for name := range given {
+		if _, ok := declared[name]; !ok {
+			if len(declared) == 0 {
+				err = fmt.Errorf("the playbook doesn't take any parameters but you gave `%s`", name)
+			} else {
+				err = fmt.Errorf("the playbook doesn't take a `%s` parameter", name)
+			}
+			return
+		}
+		for _, marker := range templateMarkers {
+			if strings.Contains(given[name], marker) {
+				err = fmt.Errorf("`%s` may not contain `%s`", name, marker)
+				return
+			}
+		}
+	}
+
+	values = make(map[string]string)
+	typed := make(map[string]interface{})
+	for name, param := range declared {
+		value, ok := given[name]
+		if !ok {
+			if param.Required {
+				err = fmt.Errorf("`%s` is required: use `%s=<value>`", name, name)
+				return
+			} else if param.Default == "" {
+				continue
+			}
+			value = param.Default
+		}
+
+		var v interface{}
+		if v, err = param.Parse(name, value); err != nil {
+			return
+		}
+		values[name], typed[name] = value, v
+	}
+
+	if len(typed) > 0 {
+		var b []byte
+		if b, err = json.Marshal(typed); err != nil {
+			return
+		}
+		vars = string(b)
+	}
+	return
+}
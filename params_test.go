@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveParamsRejectsTemplates(t *testing.T) {
+	declared := map[string]Param{
+		"version": {Type: "regex", Pattern: ".*"},
+		"message": {},
+	}
+
+	for _, value := range []string{
+		"{{ lookup('pipe', 'id') }}",
+		"1.0{% if true %}",
+		"{# comment #}",
+	} {
+		for name := range declared {
+			if _, _, err := ResolveParams(declared, map[string]string{name: value}); err == nil {
+				t.Errorf("%s=%q was accepted", name, value)
+			}
+		}
+	}
+
+	values, vars, err := ResolveParams(declared, map[string]string{"message": "a {b} c"})
+	if err != nil {
+		t.Fatalf("a value without a template was refused: %s", err)
+	}
+	if values["message"] != "a {b} c" || vars != `{"message":"a {b} c"}` {
+		t.Errorf("unexpected values %v and vars %s", values, vars)
+	}
+}
+
+func TestResolveParams(t *testing.T) {
+	declared := map[string]Param{
+		"version": {Type: "semver", Required: true},
+		"workers": {Type: "int", Default: "4"},
+		"mode":    {Type: "enum", Values: []string{"graceful", "hard"}},
+	}
+
+	tests := []struct {
+		given map[string]string
+		vars  string
+		err   string
+	}{
+		{map[string]string{"version": "1.4.2"}, `{"version":"1.4.2","workers":4}`, ""},
+		{map[string]string{"version": "v2.0.0", "mode": "hard", "workers": "8"}, `{"mode":"hard","version":"v2.0.0","workers":8}`, ""},
+		{map[string]string{}, "", "`version` is required"},
+		{map[string]string{"version": "1.4"}, "", "`version` must be a version number"},
+		{map[string]string{"version": "1.4.2", "mode": "soft"}, "", "`mode` must be one of"},
+		{map[string]string{"version": "1.4.2", "workers": "many"}, "", "`workers` must be a whole number"},
+		{map[string]string{"version": "1.4.2", "colour": "red"}, "", "doesn't take a `colour` parameter"},
+	}
+
+	for _, test := range tests {
+		_, vars, err := ResolveParams(declared, test.given)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%v: expected an error containing %q, got %v", test.given, test.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%v: unexpected error: %s", test.given, err)
+		} else if vars != test.vars {
+			t.Errorf("%v: expected vars %s, got %s", test.given, test.vars, vars)
+		}
+	}
+}
+
+func TestCheckParams(t *testing.T) {
+	stacks := map[string]Stack{
+		"website": {Playbooks: map[string]Playbook{
+			"production": {
+				Params: map[string]Param{"branch": {Type: "regex", Pattern: "release/[0-9]+"}},
+				Actions: map[string]Action{
+					"deploy": {Params: map[string]Param{"host": {Type: "regex", Pattern: "web[0-9]+"}}},
+				},
+			},
+		}},
+	}
+	if err := checkParams(stacks); err != nil {
+		t.Fatalf("valid patterns were refused: %s", err)
+	}
+
+	pb := stacks["website"].Playbooks["production"]
+	if pb.Params["branch"].re == nil || pb.Actions["deploy"].Params["host"].re == nil {
+		t.Fatal("the patterns weren't compiled")
+	}
+	params := pb.ParamsFor("deploy")
+	if _, _, err := ResolveParams(params, map[string]string{"branch": "release/12", "host": "web01"}); err != nil {
+		t.Errorf("matching values were refused: %s", err)
+	}
+	if _, _, err := ResolveParams(params, map[string]string{"branch": "release/12x"}); err == nil {
+		t.Error("a value matching only part of the pattern was accepted")
+	}
+
+	stacks["website"].Playbooks["production"].Actions["deploy"].Params["host"] = Param{Type: "regex", Pattern: "web[0-9"}
+	if err := checkParams(stacks); err == nil || !strings.Contains(err.Error(), "`host` is invalid") {
+		t.Errorf("expected the invalid pattern to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+// This provides dry runs of playbooks in check mode, summarising the changes
+// they would make.
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// maxDiffLines is the most lines of a single diff that are reported.
+	maxDiffLines = 40
+
+	// diffContext is the number of unchanged lines shown around changes.
+	diffContext = 2
+
+	// maxDiffCells limits the work done comparing large files.
+	maxDiffCells = 1000000
+)
+
+// executePlan runs the check mode playbook command args for run, reporting the
+// changes that would be made to msg.
+func executePlan(msg *Message, run *Run, args []string, executor Executor, state *RunState, config *Config) {
+	action, stack, playbook := run.Action, run.Stack, run.Playbook
+
+	var mention string
+	if run.Position > 1 {
+		mention = run.Requester + " " // Let the user know their queued plan has started.
+	}
+	if action != "run" {
+		msg.ReplyButtons(fmt.Sprintf("%sOK, I'm checking what the %s action on the *%s %s* playbook would change...", mention, action, stack, playbook), cancelButton(run))
+	} else {
+		msg.ReplyButtons(fmt.Sprintf("%sOK, I'm checking what the *%s %s* playbook would change...", mention, stack, playbook), cancelButton(run))
+	}
+
+	env := []string{"ANSIBLE_STDOUT_CALLBACK=json", "ANSIBLE_RETRY_FILES_ENABLED=0"}
+
+	record := NewRunRecord(run)
+	record.Digest = executor.Digest()
+	if err := state.History.Save(record); err != nil {
+		msg.Reply(fmt.Sprintf("I couldn't record run `%s` in my history: %s", run.ID, err))
+	}
+	defer replyFinished(msg, record)
+
+	if run.Timeout > 0 {
+		timer := time.AfterFunc(run.Timeout, func() {
+			run.Stop(fmt.Sprintf("timed out after %s", run.Timeout))
+		})
+		defer timer.Stop()
+	}
+
+	reporter := NewProgressReporter(msg.Thread().NewStatus())
+	exit, output, err := executor.Run(run.Context(), run, args, env, reporter.Progress)
+
+	// The stack isn't needed for reporting, so free it for the next run.
+	state.Finish(run)
+
+	record.End, record.Exit, record.Output = time.Now(), exit, string(output)
+	if reason := run.Stopped(); reason != "" {
+		record.Stopped = reason
+		state.History.Save(record)
+		reporter.Finish("was " + reason)
+		msg.Reply(fmt.Sprintf("The plan for *%s %s* was %s.", stack, playbook, reason))
+		return
+	} else if err != nil {
+		record.Error = err.Error()
+		state.History.Save(record)
+		reporter.Finish("could not be run")
+		msg.Reply(fmt.Sprintf("I'm sorry, I couldn't plan *%s* on *%s %s*: %s", action, stack, playbook, err))
+		return
+	} else if exit != 0 {
+		reporter.Finish("failed")
+	} else {
+		reporter.Finish("succeeded")
+	}
+
+	var results *Results
+	err = json.Unmarshal(output, &results)
+	record.Results = results
+	if err := state.History.Save(record); err != nil {
+		msg.Reply(fmt.Sprintf("I couldn't record run `%s` in my history: %s", run.ID, err))
+	}
+	if err != nil {
+		if exit == 0 {
+			msg.Send(fmt.Sprintf("Oh dear! I couldn't read the JSON returned by Ansible:```%s```", err))
+			attachOutput(msg, run, output, false, config)
+		} else {
+			reply := fmt.Sprintf("I'm sorry, the plan for *%s %s* failed", stack, playbook)
+			if attachOutput(msg, run, output, false, config) {
+				reply += ": I've attached what Ansible said to the thread."
+			} else {
+				reply += ":\n>>>" + tailOutput(output, MaxMessageLength-len(reply)-5)
+			}
+			msg.Send(reply)
+		}
+		return
+	}
+
+	for _, reply := range describePlan(run, results) {
+		msg.Reply(reply)
+	}
+	return
+}
+
+// plannedTask is a task that would change or failed on a host in check mode.
+type plannedTask struct {
+	Name string
+	Host *Host
+}
+
+// describePlan summarises, per host, the tasks in results that would make
+// changes, returning messages no longer than MaxMessageLength.
+func describePlan(run *Run, results *Results) (replies []string) {
+	hosts := make(map[string][]plannedTask)
+	for _, play := range results.Plays {
+		for _, task := range play.Tasks {
+			for name, host := range task.Hosts {
+				if host.Changed || host.Failed || host.Unreachable {
+					hosts[name] = append(hosts[name], plannedTask{task.Name.Name, host})
+				}
+			}
+		}
+	}
+
+	if len(hosts) == 0 {
+		return []string{fmt.Sprintf("Running *%s %s* wouldn't change anything on %d hosts.", run.Stack, run.Playbook, len(results.Stats))}
+	}
+
+	var names []string
+	for name := range hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reply := fmt.Sprintf("Running *%s %s* would make changes on %d of %d hosts:", run.Stack, run.Playbook, len(names), len(results.Stats))
+	for _, name := range names {
+		r := fmt.Sprintf("*%s*:", name)
+		for _, task := range hosts[name] {
+			tname := task.Name
+			if tname == "" {
+				tname = "Running the play"
+			}
+			switch {
+			case task.Host.Unreachable:
+				r += fmt.Sprintf("\n  • %s: the host is unreachable.", Sentence(tname, ""))
+			case task.Host.Failed:
+				r += fmt.Sprintf("\n  • %s would fail: %s", Sentence(tname, ""), task.Host.Msg)
+			default:
+				r += fmt.Sprintf("\n  • %s would make changes.", Sentence(tname, ""))
+			}
+			for _, diff := range task.Host.Diff {
+				if text := diff.String(); text != "" {
+					r += fmt.Sprintf("\n```\n%s\n```", text)
+				}
+			}
+		}
+
+		r = truncateMessage(r, MaxMessageLength)
+		if (len(reply) + len(r) + 1) > MaxMessageLength {
+			replies = append(replies, reply)
+			reply = r
+		} else {
+			reply += "\n" + r
+		}
+	}
+	return append(replies, reply)
+}
+
+// truncateMessage shortens s to at most max bytes, cutting it on a rune
+// boundary and closing any code block left open.
+func truncateMessage(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+
+	const more, fence = "\n...", "\n```"
+	cut := max - len(more) - len(fence)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	s = s[:cut] + more
+	if strings.Count(s, "```")%2 == 1 {
+		s += fence
+	}
+	return s
+}
+
+// String renders the diff in a unified style.
+func (d *Diff) String() string {
+	if d.Prepared != "" {
+		return truncateLines(d.Prepared, maxDiffLines)
+	}
+	if d.Before == nil && d.After == nil {
+		return ""
+	}
+
+	before, after := diffText(d.Before), diffText(d.After)
+	if before == after {
+		return ""
+	}
+
+	var lines []string
+	if d.BeforeHeader != "" || d.AfterHeader != "" {
+		lines = append(lines, "--- "+d.BeforeHeader, "+++ "+d.AfterHeader)
+	}
+	lines = append(lines, diffLines(splitLines(before), splitLines(after))...)
+	return truncateLines(strings.Join(lines, "\n"), maxDiffLines)
+}
+
+// diffText returns the text to compare for one side of a diff.
+func diffText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// truncateLines limits s to max lines.
+func truncateLines(s string, max int) string {
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	if len(lines) <= max {
+		return strings.Join(lines, "\n")
+	}
+	return strings.Join(lines[:max], "\n") + fmt.Sprintf("\n... %d more lines", len(lines)-max)
+}
+
+// diffLines returns the lines removed from a and added in b, with some
+// surrounding context, using the longest common subsequence of lines.
+func diffLines(a, b []string) (out []string) {
+	if len(a)*len(b) > maxDiffCells {
+		// Too big to compare: show it as a replacement.
+		for _, line := range a {
+			out = append(out, "-"+line)
+		}
+		for _, line := range b {
+			out = append(out, "+"+line)
+		}
+		return
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and
+	// b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var all []string
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			all = append(all, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			all = append(all, "-"+a[i])
+			i++
+		default:
+			all = append(all, "+"+b[j])
+			j++
+		}
+	}
+
+	// Only keep unchanged lines close to a change.
+	keep := make([]bool, len(all))
+	for i, line := range all {
+		if line[0] == ' ' {
+			continue
+		}
+		for k := i - diffContext; k <= i+diffContext; k++ {
+			if k >= 0 && k < len(all) {
+				keep[k] = true
+			}
+		}
+	}
+	for i, line := range all {
+		if keep[i] {
+			out = append(out, line)
+		} else if i > 0 && keep[i-1] {
+			out = append(out, "...")
+		}
+	}
+	return
+}
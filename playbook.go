@@ -1,6 +1,9 @@
 package main
 
-import "sort"
+import (
+	"encoding/json"
+	"sort"
+)
 
 type Results struct {
 	Stats map[string]*Stats `json:"stats"`
@@ -46,4 +49,38 @@ type Host struct {
 	Failed      bool   `json:failed`
 	Unreachable bool   `json:unreachable`
 	Msg         string `json:msg`
+	Changed     bool   `json:"changed"`
+	Diff        Diffs  `json:"diff,omitempty"` // Set when run with --diff.
+}
+
+// Diff describes a change made by a task, or one that would be made in check
+// mode.  Before and After are usually strings but may be structured.
+type Diff struct {
+	Before       interface{} `json:"before,omitempty"`
+	After        interface{} `json:"after,omitempty"`
+	BeforeHeader string      `json:"before_header,omitempty"`
+	AfterHeader  string      `json:"after_header,omitempty"`
+	Prepared     string      `json:"prepared,omitempty"` // A diff already rendered by the module.
+}
+
+// Diffs holds the diffs for a task, which modules report either as a single
+// diff or as a list.
+type Diffs []*Diff
+
+func (d *Diffs) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '{' {
+		var diff Diff
+		if err := json.Unmarshal(b, &diff); err != nil {
+			return err
+		}
+		*d = Diffs{&diff}
+		return nil
+	}
+
+	var diffs []*Diff
+	if err := json.Unmarshal(b, &diffs); err != nil {
+		return err
+	}
+	*d = diffs
+	return nil
 }
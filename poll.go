@@ -0,0 +1,151 @@
+package main
+
+// This provides the background checks for newer devops images, so commands
+// don't wait on the registry.
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxPollBackoff is the longest the checks are backed off for after
+	// failures.
+	maxPollBackoff = time.Hour
+
+	// pollJitter is the proportion by which the time between checks is varied
+	// at random, so several instances don't check in step.
+	pollJitter = 0.1
+)
+
+// pollImages checks for newer devops images every poll interval, announcing
+// any changes they make to the stacks.
+func pollImages(chat Chat, config *Config, logger *log.Logger) {
+	var failures int
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		settings := config.Current()
+		if settings.PollInterval == 0 || settings.DisablePull {
+			// Polling may be turned on by reloading the configuration.
+			time.Sleep(configPollInterval)
+			continue
+		}
+
+		time.Sleep(pollDelay(settings.PollInterval, failures, random.Float64()))
+		if err := refreshImages(chat, nil, config, logger); err != nil {
+			failures++
+			logger.Printf("couldn't check for newer images: %s", err)
+		} else {
+			failures = 0
+		}
+	}
+}
+
+// pollDelay returns the time to wait before the next check, doubling interval
+// for each consecutive failure up to maxPollBackoff and varying it by
+// pollJitter according to r, which is between 0 and 1.
+func pollDelay(interval time.Duration, failures int, r float64) time.Duration {
+	delay := interval
+	for i := 0; i < failures && delay < maxPollBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxPollBackoff && interval < maxPollBackoff {
+		delay = maxPollBackoff
+	}
+	return delay + time.Duration(float64(delay)*pollJitter*(2*r-1))
+}
+
+// refreshImages checks the named images, or every image if names is nil, for
+// updates, announcing any changes they make to the stacks.  Refreshes are made
+// one at a time so each compares against the stacks the last one left.
+func refreshImages(chat Chat, names []string, config *Config, logger *log.Logger) error {
+	config.updating.Lock()
+	defer config.updating.Unlock()
+
+	executors, err := NewExecutors(config)
+	if err != nil {
+		return err
+	}
+	if names == nil {
+		names = executors.Names()
+	}
+
+	old := config.Stacks()
+	if _, err = updateDevopsImages(NewLog(logger), executors, names, config); err != nil {
+		return err
+	}
+	if old == nil {
+		return nil // The stacks haven't been read yet, so nothing has changed.
+	}
+
+	if changes := describeStackChanges(old, config.Stacks()); changes != "" {
+		text := "I've picked up a newer devops image, which changes what I can run:" + changes
+		if channel := config.Current().Notifications.Runs; channel != "" {
+			chat.Post(channel, text)
+		} else {
+			NewBroadcast(chat, config.Channels).Send(text)
+		}
+	}
+	return nil
+}
+
+// describeStackChanges lists the stacks and playbooks added and removed
+// between old and new, returning an empty string if there are none.
+func describeStackChanges(old, new map[string]Stack) (text string) {
+	var names []string
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range new {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		before, wasThere := old[name]
+		after, isThere := new[name]
+		switch {
+		case !wasThere:
+			text += fmt.Sprintf("\n  • The *%s* stack is new, with %s.", name, listPlaybooks(playbookNames(after.Playbooks, nil)))
+		case !isThere:
+			text += fmt.Sprintf("\n  • The *%s* stack has gone.", name)
+		default:
+			if added := playbookNames(after.Playbooks, before.Playbooks); len(added) > 0 {
+				text += fmt.Sprintf("\n  • *%s* has gained %s.", name, listPlaybooks(added))
+			}
+			if removed := playbookNames(before.Playbooks, after.Playbooks); len(removed) > 0 {
+				text += fmt.Sprintf("\n  • *%s* has lost %s.", name, listPlaybooks(removed))
+			}
+		}
+	}
+	return
+}
+
+// playbookNames returns the sorted names of the playbooks that aren't in
+// except.
+func playbookNames(playbooks, except map[string]Playbook) (names []string) {
+	for name := range playbooks {
+		if _, ok := except[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// listPlaybooks describes the named playbooks.
+func listPlaybooks(names []string) string {
+	switch len(names) {
+	case 0:
+		return "no playbooks"
+	case 1:
+		return fmt.Sprintf("the *%s* playbook", names[0])
+	}
+	return fmt.Sprintf("the *%s* and *%s* playbooks", strings.Join(names[:len(names)-1], "*, *"), names[len(names)-1])
+}
@@ -5,25 +5,56 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fsouza/go-dockerclient"
-	"github.com/nlopes/slack"
 	yaml "gopkg.in/yaml.v2"
 )
 
-var pulling Toggle
-
 func sendHelp(intro string, msg *Message) {
 	msg.Reply(fmt.Sprintf(`%s. I can help with the following commands:
 • *%s* - run a playbook.
 • *%s* - list playbooks I can run.
+• *%s* - show what running a playbook would change.
+• *%s* - show the playbooks waiting to run.
+• *%s* - remove a playbook from the queue.
+• *%s* - stop a running playbook.
+• *%s* - approve a run that needs approval.
+• *%s* - refuse a run that needs approval.
+• *%s* - go ahead with a production run you asked for.
+• *%s* - drop a production run you asked for.
+• *%s* - list the playbooks I've run recently.
+• *%s* - describe a run in detail.
+• *%s* - attach the output of a run.
+• *%s* - run a playbook again.
+• *%s* - list the runs I start on a schedule.
+• *%s* - stop playbooks being run for a while.
+• *%s* - lift a freeze.
+• *%s* - list or roll back the devops image digests.
 • *%s* - give an idea of how advanced I am.
 Use *%s* for further details.`,
 		intro,
 		"`run`",
 		"`list`",
+		"`plan`",
+		"`queue`",
+		"`dequeue`",
+		"`cancel`",
+		"`approve`",
+		"`deny`",
+		"`confirm`",
+		"`abort`",
+		"`history`",
+		"`show`",
+		"`log`",
+		"`rerun`",
+		"`schedules`",
+		"`freeze`",
+		"`unfreeze`",
+		"`image`",
 		"`version`",
 		"`help <command>`",
 	))
@@ -46,11 +77,43 @@ func processHelp(msg *Message, cmd []string) {
 
 	switch cmd[0] {
 	case "drun":
-		msg.Reply("Use *`run <stack> <playbook>`* to run a playbook related to a stack. If a stack has custom actions associated with it then just replace `run` with the name of the action.")
+		msg.Reply("Use *`run <stack> <playbook>`* to run a playbook related to a stack. If a stack has custom actions associated with it then just replace `run` with the name of the action.  If the playbook allows it you can add `--limit <hosts>`, `--tags <tags>` or `--skip-tags <tags>` to run against some of the hosts or tasks.")
 	case "list":
 		helpList("", msg)
+	case "plan":
+		msg.Reply("Use *`plan <stack> <playbook>`* or *`plan <stack> <playbook> <action>`* to do a dry run of a playbook in Ansible's check mode.  I'll tell you which tasks would make changes on each host along with the differences they'd make.")
+	case "queue":
+		msg.Reply("Use *`queue`* to see the playbooks running and waiting to run for every stack, or *`queue <stack>`* for a single stack.  If a stack is busy when you ask me to run one of its playbooks, I'll queue your run and start it as soon as the stack is free.")
+	case "dequeue":
+		msg.Reply("Use *`dequeue <id>`* to remove a waiting run from the queue.  The ID is the one I gave you when the run was queued.")
+	case "cancel":
+		msg.Reply("Use *`cancel <stack>`* or *`cancel <id>`* to stop the playbook that's running.  I'll ask it to stop nicely before forcing it to, and then tell you what had completed.")
+	case "approve":
+		msg.Reply("Use *`approve <id>`* to allow a run that needs approval to go ahead.  You can't approve your own runs, and you need to be allowed to run the playbook yourself.")
+	case "deny":
+		msg.Reply("Use *`deny <id>`* to drop a run that needs approval.  Whoever requested the run can also use this to withdraw it.")
+	case "confirm":
+		msg.Reply(fmt.Sprintf("Playbooks marked as production in `lurch.yml` don't run until you confirm them.  Use *`confirm <id>`* within %s to go ahead with your run.", confirmTimeout))
+	case "abort":
+		msg.Reply("Use *`abort <id>`* to drop a production run you asked for instead of confirming it.")
+	case "log":
+		msg.Reply("Use *`log <id>`* to have me attach everything Ansible said during a run.")
+	case "rerun":
+		msg.Reply("Use *`rerun <id>`* to run a playbook again with the same action, parameters and options as before.  A freeze needs overriding again, and production runs need confirming again.")
+	case "history":
+		msg.Reply(fmt.Sprintf("Use *`history`* to list the last %d playbooks I've run, or *`history <stack>`* to limit this to a single stack.", historyLength))
+	case "freeze":
+		msg.Reply("Use *`freeze <stack> <duration> <reason>`* to stop playbooks from *<stack>* being run for a while, e.g. *`freeze my-website 2h investigating the outage`*, or use `*` as the stack to freeze everything.  Use *`freeze`* on its own to see what's frozen.  Plans can still be made, and anyone allowed to override a freeze can run a playbook anyway by adding `--override-freeze \"<reason>\"`.")
+	case "unfreeze":
+		msg.Reply("Use *`unfreeze <stack>`* to lift a freeze made with *`freeze`*.  Freezes in my configuration file can only be lifted by changing it.")
+	case "schedules":
+		msg.Reply("Use *`schedules`* to list the playbooks I run automatically according to the schedules in `lurch.yml`, along with when I'll next run them.")
+	case "show":
+		msg.Reply("Use *`show <id>`* to find out who ran a playbook and when, what it ran with and what happened.")
+	case "image":
+		msg.Reply("Use *`image history`* to list the digests of the devops image I've run playbooks from, and *`image use <digest>`* to keep using an earlier one if a new image breaks things, e.g. *`image use 4f2a9c1e`*.  Use *`image unpin`* to go back to the latest image.  If I have more than one image, name it after `image`, e.g. *`image infra history`*.")
 	case "version":
-		msg.Reply("This provides the version number I'm tagged with and the commit ID I was built from.")
+		msg.Reply("This provides the version number I'm tagged with, the commit ID I was built from and the digests of the devops images I'm running playbooks from.")
 	default:
 		msg.Reply("How about giving me a chance and using a command I understand?!")
 	}
@@ -78,17 +141,48 @@ func Sentence(s, suffix string) string {
 	return strings.ToUpper(string([]rune(s)[0])) + s[1:] + suffix
 }
 
-func listStacks(msg *Message, config *Config) {
-	stacks := config.GetStackList()
+// identify returns the identity of the user sending msg for checking what
+// they may run, replying if it can't be established.
+func identify(msg *Message, config *Config) *Identity {
+	who, err := config.Access.Identify(msg.ev.User)
+	if err != nil {
+		msg.Reply(fmt.Sprintf("%s, so I can't check what you're allowed to run.", err))
+	}
+	return who
+}
+
+// stackImage returns the name of the image stack comes from, or an empty
+// string if there's only one image.
+func stackImage(stack string, config *Config) string {
+	if settings := config.Current(); settings.Executor != "docker" || len(settings.DockerImages()) < 2 {
+		return ""
+	}
+	return config.Stacks()[stack].Image
+}
+
+func listStacks(msg *Message, who *Identity, config *Config) {
+	stacks := config.Access.Stacks(who, config)
 
 	var reply string
-	switch len(stacks) {
-	case 0:
+	switch {
+	case len(stacks) == 0 && len(config.Stacks()) > 0:
+		reply = "I'm sorry, you're not allowed to run anything from any of my stacks."
+	case len(stacks) == 0:
 		reply = "Sorry, there don't seem to be any stacks at the moment."
-	case 1:
-		reply = fmt.Sprintf("I only know about the *%s* stack.", stacks[0])
+	case len(stacks) == 1:
+		reply = fmt.Sprintf("I only know about the *%s* stack", stacks[0])
+		if image := stackImage(stacks[0], config); image != "" {
+			reply += fmt.Sprintf(" from the *%s* image", image)
+		}
+		reply += "."
 	default:
-		reply = fmt.Sprintf("I know about the following %d stacks:\n  • %s", len(stacks), strings.Join(stacks, "\n  • "))
+		reply = fmt.Sprintf("I know about the following %d stacks:", len(stacks))
+		for _, stack := range stacks {
+			reply += fmt.Sprintf("\n  • %s", stack)
+			if image := stackImage(stack, config); image != "" {
+				reply += fmt.Sprintf(" (from *%s*)", image)
+			}
+		}
 	}
 
 	msg.Reply(reply)
@@ -96,7 +190,7 @@ func listStacks(msg *Message, config *Config) {
 }
 
 func getStack(msg *Message, name string, config *Config) (stack *Stack) {
-	if s, ok := config.Stacks[name]; !ok {
+	if s, ok := config.Stacks()[name]; !ok {
 		msg.Reply(fmt.Sprintf("Oh dear.  I'm afraid I don't know anything about the *%s* stack.  Perhaps it's a typo or perhaps you need to configure it?", name))
 		return
 	} else {
@@ -117,21 +211,24 @@ func getPlaybook(msg *Message, name string, stack *Stack) (playbook *Playbook) {
 	return
 }
 
-func listStack(msg *Message, name string, config *Config) {
+func listStack(msg *Message, who *Identity, name string, config *Config) {
 	stack := getStack(msg, name, config)
 	if stack == nil {
 		return
 	}
 
 	var reply string
-	playbooks := stack.GetPlaybookList()
+	playbooks := config.Access.Playbooks(who, name, *stack)
 	pc := len(playbooks)
-	switch pc {
-	case 0:
+	switch {
+	case pc == 0 && len(stack.Playbooks) > 0:
+		reply = fmt.Sprintf("I'm sorry, you're not allowed to run anything from *%s*.", name)
+	case pc == 0:
 		reply = fmt.Sprintf("It doesn't look like there are any playbooks associated with *%s*.", name)
-	case 1:
+	case pc == 1:
 		playbook := playbooks[0]
 		pb := stack.Playbooks[playbook]
+		actions := config.Access.Actions(who, name, playbook, pb)
 		reply = fmt.Sprintf("The *%s* stack only has the *%s* playbook", name, playbook)
 		if pb.About != "" {
 			reply += fmt.Sprintf(" designed to %s.", Desentence(pb.About))
@@ -139,12 +236,12 @@ func listStack(msg *Message, name string, config *Config) {
 			reply += " associated with it."
 		}
 
-		switch len(pb.Actions) {
+		switch len(actions) {
 		case 0:
 		case 1:
 			reply += "  This has 1 additional action you can invoke."
 		default:
-			reply += fmt.Sprintf("  This has %s additional actions you can invoke.", len(pb.Actions))
+			reply += fmt.Sprintf("  This has %s additional actions you can invoke.", len(actions))
 		}
 
 	default:
@@ -152,24 +249,27 @@ func listStack(msg *Message, name string, config *Config) {
 		for _, pname := range playbooks {
 			pb := stack.Playbooks[pname]
 			reply += fmt.Sprintf("\n  • *%s*", pname)
-			switch len(pb.Actions) {
+			switch ac := len(config.Access.Actions(who, name, pname, pb)); ac {
 			case 0:
 			case 1:
 				reply += " (with 1 action)"
 			default:
-				reply += fmt.Sprintf(" (with %d actions)", len(pb.Actions))
+				reply += fmt.Sprintf(" (with %d actions)", ac)
 			}
 			if pb.About != "" {
 				reply += fmt.Sprintf(": %s", Desentence(pb.About))
 			}
 		}
 	}
+	if image := stackImage(name, config); image != "" && pc > 0 {
+		reply += fmt.Sprintf("\nIts playbooks come from the *%s* image.", image)
+	}
 
 	msg.Reply(reply)
 	return
 }
 
-func listPlaybook(msg *Message, stack, playbook string, config *Config) {
+func listPlaybook(msg *Message, who *Identity, stack, playbook string, config *Config) {
 	st := getStack(msg, stack, config)
 	if st == nil {
 		return
@@ -180,7 +280,12 @@ func listPlaybook(msg *Message, stack, playbook string, config *Config) {
 		return
 	}
 
-	actions := pb.GetActionList()
+	actions := config.Access.Actions(who, stack, playbook, *pb)
+	if len(actions) == 0 && !config.Access.Allows(who, stack, playbook, "run") {
+		msg.Reply(fmt.Sprintf("I'm sorry, you're not allowed to run anything from the *%s* playbook.", playbook))
+		return
+	}
+
 	var reply string
 	ac := len(actions)
 	switch ac {
@@ -195,6 +300,9 @@ func listPlaybook(msg *Message, stack, playbook string, config *Config) {
 		} else {
 			reply += " associated with it."
 		}
+		if len(action.Params) > 0 {
+			reply += "  This takes the following parameters:" + DescribeParams(action.Params, "  ")
+		}
 	default:
 		reply = fmt.Sprintf("The *%s* playbook has %d actions associated with it:", playbook, ac)
 		for _, name := range actions {
@@ -203,39 +311,40 @@ func listPlaybook(msg *Message, stack, playbook string, config *Config) {
 			if a.About != "" {
 				reply += fmt.Sprintf(": %s", Desentence(a.About))
 			}
+			reply += DescribeParams(a.Params, "      ")
 		}
 	}
 
+	if len(pb.Params) > 0 {
+		reply += fmt.Sprintf("\nThe *%s* playbook takes the following parameters, which you give as `name=value`:", playbook)
+		reply += DescribeParams(pb.Params, "  ")
+	}
+
 	msg.Reply(reply)
 	return
 }
 
 func processList(msg *Message, cmd []string, config *Config) {
-	client, err := getDockerClient()
-	if err != nil {
-		msg.Reply(fmt.Sprintf("I could not create the Docker client: %s", err))
-		return
-	}
-
-	if _, err = updateDevopsImage(msg, client, config); err != nil {
+	if len(config.Stacks()) == 0 {
+		msg.Reply("I'm sorry; there aren't any stacks listed.")
 		return
 	}
 
-	if len(config.Stacks) == 0 {
-		msg.Reply("I'm sorry; there aren't any stacks listed.")
+	who := identify(msg, config)
+	if who == nil {
 		return
 	}
 
 	switch len(cmd) {
 	case 0:
-		listStacks(msg, config)
+		listStacks(msg, who, config)
 	case 1:
 		stack := cmd[0]
-		listStack(msg, stack, config)
+		listStack(msg, who, stack, config)
 	case 2:
 		stack := cmd[0]
 		playbook := cmd[1]
-		listPlaybook(msg, stack, playbook, config)
+		listPlaybook(msg, who, stack, playbook, config)
 	default:
 		helpList("I'm sorry, I have no idea what you're asking", msg)
 	}
@@ -243,49 +352,72 @@ func processList(msg *Message, cmd []string, config *Config) {
 	return
 }
 
-func updateConfigFromImage(msg Conversation, client *docker.Client, config *Config) (err error) {
-	var (
-		output    []byte
-		exit      int
-		lurchYaml string = "lurch.yml"
-	)
+func updateConfigFromImage(msg Conversation, executors Executors, config *Config) (err error) {
+	var lurchYaml string = "lurch.yml"
 
-	exit, output, err = runDockerCommand(client, config.Docker.Image, config.Docker.Tag, []string{"cat", lurchYaml}, nil)
-	if err != nil {
-		msg.Send(fmt.Sprintf("I'm sorry, I couldn't update my configuration from the new image.  The message I got is:\n```%s```", err))
-		return
-	}
+	// Merge the stacks from every image, recording which image each comes
+	// from.
+	stacks := make(map[string]Stack)
+	for _, name := range executors.Names() {
+		executor := executors[name]
 
-	if exit != 0 {
-		result := string(output)
-		msg.Send(fmt.Sprintf("I'm sorry, I couldn't update my configuration from the new image.  This is the output I got:\n```%s```", result))
-		err = fmt.Errorf("docker command failed: %s", result)
-		return
-	}
+		var output []byte
+		if output, err = executor.ReadFile(lurchYaml); err != nil {
+			msg.Send(fmt.Sprintf("I'm sorry, I couldn't update my configuration from %s.  The message I got is:\n```%s```", executor, err))
+			return
+		}
 
-	// Unmarshal the YAML string returned from Docker.
-	var stacks map[string]Stack
-	if err = yaml.Unmarshal(output, &stacks); err != nil {
-		msg.Send(fmt.Sprintf("Oh dear! I couldn't read the %s file from the docker image:\n```%s```", lurchYaml, err))
+		// Unmarshal the YAML string returned by the executor.
+		var found map[string]Stack
+		if err = yaml.Unmarshal(output, &found); err != nil {
+			msg.Send(fmt.Sprintf("Oh dear! I couldn't read the %s file from %s:\n```%s```", lurchYaml, executor, err))
+			return
+		}
+		for stack, st := range found {
+			if other, ok := stacks[stack]; ok {
+				err = fmt.Errorf("the *%s* stack is in both the %s and %s images", stack, other.Image, name)
+				msg.Send(fmt.Sprintf("Oh dear! I can't use the %s file from %s: %s.  Stack names need to be unique across images.", lurchYaml, executor, err))
+				return
+			}
+			st.Image = name
+			stacks[stack] = st
+		}
+	}
+	if err = checkSchedules(stacks); err == nil {
+		err = checkParams(stacks)
+	}
+	if err != nil {
+		msg.Send(fmt.Sprintf("Oh dear! There's a problem with the %s files: %s", lurchYaml, err))
 		return
 	}
 
-	// This needs to be wrapped in a mutex.
-	config.Stacks = stacks
+	config.SetStacks(stacks)
 	return
 }
 
-func updateDevopsImage(msg Conversation, client *docker.Client, config *Config) (updated bool, err error) {
-	// Check whether the image should even be updated.
-	if config.DisablePull {
+func updateDevopsImage(msg Conversation, executors Executors, config *Config) (updated bool, err error) {
+	return updateDevopsImages(msg, executors, executors.Names(), config)
+}
+
+// updateDevopsImages checks the named images for updates, reading the stacks
+// from every image again if any were updated.
+func updateDevopsImages(msg Conversation, executors Executors, names []string, config *Config) (updated bool, err error) {
+	// Check whether the images should even be updated.
+	if config.Current().DisablePull {
 		return
 	}
 
-	if updated, err = pullDevopsImage(msg, client, config.Docker.Image, config.Docker.Tag, config.Docker.Auth); err != nil {
-		return
-	} else if updated {
+	for _, name := range names {
+		var u bool
+		if u, err = executors[name].Update(msg); err != nil {
+			return
+		}
+		updated = updated || u
+	}
+
+	if updated {
 		// Update the configuration as well.
-		if err = updateConfigFromImage(msg, client, config); err != nil {
+		if err = updateConfigFromImage(msg, executors, config); err != nil {
 			return
 		}
 	}
@@ -293,15 +425,9 @@ func updateDevopsImage(msg Conversation, client *docker.Client, config *Config)
 	return
 }
 
+// pullDevopsImage pulls the image, returning whether it changed and keeping
+// msg informed if it takes a while.
 func pullDevopsImage(msg Conversation, client *docker.Client, image, tag string, auth docker.AuthConfiguration) (updated bool, err error) {
-	if pulling.IsOn() {
-		msg.Send("Try again in a sec: I'm busy pulling the latest devops Docker image.")
-		err = errors.New("already pulling image")
-		return
-	}
-	pulling.On()
-	defer pulling.Off()
-
 	// Start the timeout.
 	timeout := make(chan bool, 1)
 	go func() {
@@ -309,13 +435,14 @@ func pullDevopsImage(msg Conversation, client *docker.Client, image, tag string,
 		timeout <- true
 	}()
 
-	status := make(chan string, 1)
+	status := make(chan bool, 1) // Whether the image changed.
 	errors := make(chan error, 1)
 	go func() {
-		if result, err := pullDockerImage(client, image, tag, auth); err != nil {
+		changed, err := pullImageOnce(client, image, tag, auth)
+		if err != nil {
 			errors <- err
 		} else {
-			status <- result
+			status <- changed
 		}
 	}()
 
@@ -330,27 +457,19 @@ Loop:
 				msg.Send(fmt.Sprintf("I tried and failed to check for an updated devops Docker image.  This is the message I received:\n```%s``` You'll need to dig into it I'm afraid :disappointed:.", err.Error()))
 			}
 			break Loop
-		case r := <-status:
+		case updated = <-status:
 			if timeoutSent {
 				// If a holding message has been sent, the user is entitled to
 				// know what the end result is.
-				if strings.HasPrefix(r, "Status: Downloaded newer") {
-					updated = true
+				if updated {
 					msg.Send("Great - there's a newer image that I'm now using.")
-				} else if strings.HasPrefix(r, "Status: Image is up to date") {
-					msg.Send("No new image is available: I'll continue using the existing one...")
 				} else {
-					msg.Send(fmt.Sprintf("I received this message whilst checking for the image.  Not sure what it means...\n```%s```", r))
+					msg.Send("No new image is available: I'll continue using the existing one...")
 				}
-			} else if strings.HasPrefix(r, "Status: Downloaded newer") {
-				updated = true
+			} else if updated {
 				msg.Send("Ah!  I've just retrieved the latest devops Docker image. :triumph:")
-			} else if strings.HasPrefix(r, "Status: Image is up to date") {
-				// Ignore messages where the image status hasn't changed and no timeout was triggered.
-			} else {
-				// An unknown message: we'd better pass it on.
-				msg.Send(fmt.Sprintf("I'm passing on this message I received when checking for an updated devops Docker image.  Not sure what it means...\n```%s```", r))
 			}
+			// Ignore images that haven't changed when no timeout was triggered.
 			break Loop
 		case <-timeout:
 			// We're holding things up: update the user with a holding message.
@@ -362,39 +481,22 @@ Loop:
 	return
 }
 
-func lockStack(msg *Message, stack string, state *RunState) (unlock func()) {
-	if !state.Set(stack) {
-		msg.Reply(fmt.Sprintf("Patience! I'm already busy running a playbook from *%s* - please wait until I'm done.", stack))
-		return
-	}
-
-	unlock = func() {
-		state.Unset(stack)
-	}
-
-	return
-}
-
-func runStack(msg *Message, action, stack string, state *RunState, config *Config) {
-	unlock := lockStack(msg, stack, state)
-	if unlock == nil {
-		return
-	}
-	defer unlock()
-
+func runStack(msg *Message, who *Identity, action, stack string, config *Config) {
 	st := getStack(msg, stack, config)
 	if st == nil {
 		return
 	}
 
 	var reply string
-	playbooks := st.GetPlaybookList()
+	playbooks := config.Access.Playbooks(who, stack, *st)
 	pc := len(playbooks)
 
-	switch pc {
-	case 0:
+	switch {
+	case pc == 0 && len(st.Playbooks) > 0:
+		reply = fmt.Sprintf("I'm sorry, you're not allowed to run anything from *%s*.", stack)
+	case pc == 0:
 		reply = fmt.Sprintf("It doesn't look like there are any playbooks associated with *%s*", stack)
-	case 1:
+	case pc == 1:
 		reply = fmt.Sprintf("The *%s* stack only has the *%s* playbook associated with it but you need to explicitly type it.", stack, playbooks[0])
 	default:
 		reply = fmt.Sprintf("Please specify a playbook from the *%s* stack:\n  • %s", stack, strings.Join(playbooks, "\n  • "))
@@ -403,25 +505,21 @@ func runStack(msg *Message, action, stack string, state *RunState, config *Confi
 	return
 }
 
-func runPlaybook(msg *Message, action, stack, playbook string, client *docker.Client, state *RunState, config *Config) {
-	unlock := lockStack(msg, stack, state)
-	if unlock == nil {
-		return
-	}
-	defer unlock()
-
-	st := getStack(msg, stack, config)
-	if st == nil {
+// prepareRun validates a request by who to run action on playbook from stack,
+// or a dry run of it if plan is true.  who is nil for scheduled runs.  It
+// returns the run along with the ansible-playbook command to execute and the
+// playbook being run.  Errors are suitable for showing to the user.
+func prepareRun(who *Identity, action, stack, playbook string, opts *RunOptions, params map[string]string, plan bool, config *Config) (run *Run, args []string, pb Playbook, err error) {
+	st, ok := config.Stacks()[stack]
+	if !ok {
+		err = fmt.Errorf("Oh dear.  I'm afraid I don't know anything about the *%s* stack.  Perhaps it's a typo or perhaps you need to configure it?", stack)
 		return
 	}
 
 	// Ensure the playbook requested actually exists.
-	var pb Playbook
-	if p, ok := st.Playbooks[playbook]; !ok {
-		msg.Reply(fmt.Sprintf("Hmmm.  I'm not aware of the *%s* playbook being part of the *%s* stack.", playbook, stack))
+	if pb, ok = st.Playbooks[playbook]; !ok {
+		err = fmt.Errorf("Hmmm.  I'm not aware of the *%s* playbook being part of the *%s* stack.", playbook, stack)
 		return
-	} else {
-		pb = p
 	}
 
 	// Ensure the action is valid.
@@ -432,55 +530,523 @@ func runPlaybook(msg *Message, action, stack, playbook string, client *docker.Cl
 			// Describe actions that do exist
 			switch len(actions) {
 			case 0:
-				msg.Reply(fmt.Sprintf("I'm afraid the %s playbook doesn't have any custom actions.", playbook))
+				err = fmt.Errorf("I'm afraid the %s playbook doesn't have any custom actions.", playbook)
 			case 1:
-				msg.Reply(fmt.Sprintf("Hmmm.  I don't know that action: the only custom action associated with *%s* is *%s*.", stack, playbook))
+				err = fmt.Errorf("Hmmm.  I don't know that action: the only custom action associated with *%s* is *%s*.", stack, playbook)
 			case 2:
-				msg.Reply(fmt.Sprintf("Hmmm.  I don't know that action: the only custom action associated with *%s* is *%s*.", stack, playbook))
+				err = fmt.Errorf("Hmmm.  I don't know that action: the only custom action associated with *%s* is *%s*.", stack, playbook)
 			default:
-				msg.Reply(fmt.Sprintf("Hmmm.  I don't know that action: these are the custom actions for *%s* that I'm aware of:\n   • %s", stack, strings.Join(actions, "\n  • ")))
+				err = fmt.Errorf("Hmmm.  I don't know that action: these are the custom actions for *%s* that I'm aware of:\n   • %s", stack, strings.Join(actions, "\n  • "))
 			}
 
 			return
 		} else {
 			act = &a
 		}
+	}
 
-		msg.Reply(fmt.Sprintf("OK, I'm running the %s action on the *%s %s* playbook...", action, stack, playbook))
+	// Ensure the user may run it.  Scheduled runs have no user.
+	if who != nil && !config.Access.Allows(who, stack, playbook, action) {
+		err = fmt.Errorf("I'm sorry, you're not allowed to %s *%s %s*.", action, stack, playbook)
+		return
+	}
+
+	// Ensure the stack isn't frozen.  Plans don't change anything so can go
+	// ahead.
+	if !plan {
+		if err = checkFreeze(who, stack, playbook, action, opts, config); err != nil {
+			return
+		}
 	} else {
-		msg.Reply(fmt.Sprintf("OK, I'm running the *%s %s* playbook...", stack, playbook))
+		opts.OverrideFreeze = "" // There's nothing to override.
+	}
+
+	// Ensure the options are permitted.
+	if err = opts.Check(pb); err != nil {
+		err = fmt.Errorf("I'm sorry, %s.", err)
+		return
+	}
+
+	// Ensure the parameters are valid.
+	values, vars, err := ResolveParams(pb.ParamsFor(action), params)
+	if err != nil {
+		err = fmt.Errorf("I'm sorry, %s.", err)
+		return
 	}
 
 	// Build the Ansible command.
-	args := []string{"ansible-playbook"}
+	args = []string{"ansible-playbook"}
 	if act != nil {
 		for k, v := range act.Vars {
 			args = append(args, []string{"--extra-vars", fmt.Sprintf("%s=%s", k, v)}...)
 		}
 	}
+	if vars != "" {
+		args = append(args, "--extra-vars", vars)
+	}
+	args = append(args, opts.Args()...)
+	if plan {
+		args = append(args, "--check", "--diff")
+	}
 	args = append(args, pb.Location)
 
-	env := []string{"ANSIBLE_STDOUT_CALLBACK=json", "ANSIBLE_RETRY_FILES_ENABLED=0"}
-	exit, output, err := runDockerCommand(client, config.Docker.Image, config.Docker.Tag, args, env)
+	run = NewRun(stack, playbook, action, nil)
+	run.Plan, run.Options, run.Params = plan, opts, values
+	if act != nil {
+		run.Vars = act.Vars
+	}
+	if run.Timeout = pb.Timeout; run.Timeout == 0 {
+		run.Timeout = config.Current().RunTimeout
+	}
+	return
+}
+
+// startRun queues run to execute args, reporting to msg, starting it straight
+// away if the stack is idle.  It returns the position of the run in the queue,
+// or zero if it is being held until someone approves it.
+func startRun(msg *Message, run *Run, args []string, pb Playbook, executor Executor, state *RunState, config *Config) (position int) {
+	run.start = func() {
+		if freeze := frozenRun(run, config); freeze != nil {
+			dropFrozen(msg, run, freeze)
+			state.Finish(run)
+			return
+		}
+		if run.Plan {
+			executePlan(msg, run, args, executor, state, config)
+		} else {
+			executePlaybook(msg, run, args, executor, state, config)
+		}
+	}
+	run.User, run.Requester, run.Channel = msg.ev.User, msg.ev.UserMention, msg.ev.Channel
+
+	// Hold the run if someone else needs to approve it.  Plans don't change
+	// anything so don't need approval.
+	if required, approvers := pb.Approval(run.Action); required && !run.Plan {
+		run.Approvers = approvers
+		requestApproval(msg, run, state, config)
+		return
+	}
+
+	return state.Enqueue(run)
+}
+
+// runPlaybook queues action on playbook from stack, or a dry run of it if plan
+// is true.
+func runPlaybook(msg *Message, who *Identity, action, stack, playbook string, opts *RunOptions, params map[string]string, plan bool, executors Executors, state *RunState, config *Config, logger *log.Logger) {
+	run, args, pb, err := prepareRun(who, action, stack, playbook, opts, params, plan, config)
+	if err != nil {
+		msg.Reply(err.Error())
+		return
+	}
+
+	executor, err := executors.For(stack, config)
+	if err != nil {
+		run.cancel()
+		msg.Reply(fmt.Sprintf("I'm sorry, %s.", err))
+		return
+	}
+
+	if run.Options.OverrideFreeze != "" {
+		logFreezeOverride(logger, who, run)
+		msg.Reply(fmt.Sprintf("I'm overriding the freeze on *%s* for `%s` because %s.", stack, run.ID, Desentence(run.Options.OverrideFreeze)))
+	}
+
+	start := func() (pos int) {
+		if pos = startRun(msg, run, args, pb, executor, state, config); pos > 1 {
+			msg.Reply(fmt.Sprintf("I'm busy running a playbook from *%s* so I've queued your run as `%s`: you're #%d for *%s*.", stack, run.ID, pos, stack))
+		}
+		return
+	}
+
+	// Make sure runs against production aren't a slip of the finger.  Plans
+	// don't change anything so go ahead.
+	if pb.NeedsConfirmation(action) && !plan {
+		requestConfirmation(msg, run, state, start)
+		return
+	}
+
+	start()
+	return
+}
+
+// confirmTimeout is how long a production run waits to be confirmed.
+const confirmTimeout = 5 * time.Minute
+
+// requestConfirmation holds run until its requester confirms it, calling start
+// once they do.  The run is dropped if it isn't confirmed in time.
+func requestConfirmation(msg *Message, run *Run, state *RunState, start func() int) {
+	run.User, run.Requester, run.Channel = msg.ev.User, msg.ev.UserMention, msg.ev.Channel
+	run.Confirming, run.resume = true, start
+	state.Park(run)
+
+	time.AfterFunc(confirmTimeout, func() {
+		if _, err := state.UnparkIf(run.ID, true); err == nil {
+			msg.Reply(fmt.Sprintf("%s you didn't confirm `%s` within %s so I've dropped it.", run.Requester, run.ID, confirmTimeout))
+		}
+	})
+
+	reply := fmt.Sprintf("*%s %s*", run.Stack, run.Playbook)
+	if run.Action != "run" {
+		reply += fmt.Sprintf(" (%s)", run.Action)
+	}
+	if s := run.Options.String(); s != "" {
+		reply += fmt.Sprintf(" with `%s`", s)
+	}
+	reply += fmt.Sprintf(" affects production.  %s are you sure?  Reply *`confirm %s`* within %s to run it, or *`abort %s`* to drop it.", run.Requester, run.ID, confirmTimeout, run.ID)
+	msg.ReplyButtons(reply,
+		Button{Text: "Confirm", Command: "confirm " + run.ID, Style: "primary", Once: true},
+		Button{Text: "Abort", Command: "abort " + run.ID, Style: "danger", Once: true})
+}
+
+// confirmRun removes the run identified by cmd from those awaiting
+// confirmation if the sender of msg requested it, replying if they can't.  The
+// run is dropped unless it's being confirmed.
+func confirmRun(msg *Message, cmd []string, verb string, state *RunState) *Run {
+	if len(cmd) != 1 {
+		msg.Reply(fmt.Sprintf("Use *`%s <id>`* with the ID of the run awaiting confirmation.", verb))
+		return nil
+	}
+
+	run, err := state.Pending(cmd[0])
+	if err == nil && !run.Confirming {
+		err = errors.New("there's no run awaiting confirmation with that ID")
+	}
+	if err != nil {
+		msg.Reply(fmt.Sprintf("I couldn't %s `%s`: %s.", verb, cmd[0], err))
+		return nil
+	}
+	if run.User != msg.ev.User {
+		msg.Reply(fmt.Sprintf("I'm sorry, only %s can %s `%s`.", run.Requester, verb, run.ID))
+		return nil
+	}
+
+	// The run may have timed out or been confirmed from elsewhere.
+	unpark := state.UnparkIf
+	if verb == "confirm" {
+		unpark = state.Release
+	}
+	if run, err = unpark(run.ID, true); err != nil {
+		msg.Reply(fmt.Sprintf("I couldn't %s `%s`: %s.", verb, cmd[0], err))
+		return nil
+	}
+	return run
+}
+
+func processConfirm(msg *Message, cmd []string, state *RunState, config *Config) {
+	run := confirmRun(msg, cmd, "confirm", state)
+	if run == nil {
+		return
+	}
+	if freeze := frozenRun(run, config); freeze != nil {
+		run.cancel()
+		dropFrozen(msg, run, freeze)
+		return
+	}
+
+	run.Confirming = false
+	run.resume()
+	return
+}
+
+func processAbort(msg *Message, cmd []string, state *RunState) {
+	run := confirmRun(msg, cmd, "abort", state)
+	if run == nil {
+		return
+	}
+
+	msg.Reply(fmt.Sprintf("OK, I've dropped `%s` (*%s %s*).", run.ID, run.Stack, run.Playbook))
+	return
+}
+
+// requestApproval holds run until it is approved, dropping it if it isn't
+// approved in time.
+func requestApproval(msg *Message, run *Run, state *RunState, config *Config) {
+	state.Park(run)
+
+	reply := fmt.Sprintf("*%s %s*", run.Stack, run.Playbook)
+	if run.Action != "run" {
+		reply += fmt.Sprintf(" (%s)", run.Action)
+	}
+	reply += " needs approval before I can run it.  Someone else"
+	if run.Approvers != "" {
+		reply += fmt.Sprintf(" from the *%s* group", run.Approvers)
+	}
+	reply += fmt.Sprintf(" needs to reply *`approve %s`*", run.ID)
+	if timeout := config.Current().ApprovalTimeout; timeout > 0 {
+		reply += fmt.Sprintf(" within %s", timeout)
+
+		time.AfterFunc(timeout, func() {
+			if _, err := state.Unpark(run.ID); err == nil {
+				msg.Reply(fmt.Sprintf("%s your run `%s` wasn't approved within %s so I've dropped it.", run.Requester, run.ID, timeout))
+			}
+		})
+	}
+	reply += fmt.Sprintf(", or *`deny %s`* to drop it.", run.ID)
+	msg.ReplyButtons(reply,
+		Button{Text: "Approve", Command: "approve " + run.ID, Style: "primary"},
+		Button{Text: "Deny", Command: "deny " + run.ID, Style: "danger"})
+}
+
+// checkApprover returns whether the sender of msg may approve or deny run,
+// replying if they can't.
+func checkApprover(msg *Message, run *Run, config *Config) bool {
+	if run.User == msg.ev.User {
+		msg.Reply("I'm sorry, someone else has to approve your run.")
+		return false
+	}
+
+	who := identify(msg, config)
+	if who == nil {
+		return false
+	}
+	if !config.Access.Allows(who, run.Stack, run.Playbook, run.Action) {
+		msg.Reply(fmt.Sprintf("I'm sorry, only people who may run *%s %s* themselves can approve it.", run.Stack, run.Playbook))
+		return false
+	}
+
+	if run.Approvers != "" {
+		member, err := config.Access.InGroup(msg.ev.User, run.Approvers)
+		if err != nil {
+			msg.Reply(fmt.Sprintf("I couldn't look up the members of the %s group: %s.", run.Approvers, err))
+			return false
+		} else if !member {
+			msg.Reply(fmt.Sprintf("I'm sorry, only members of the *%s* group can approve `%s`.", run.Approvers, run.ID))
+			return false
+		}
+	}
+
+	return true
+}
+
+func processApprove(msg *Message, cmd []string, state *RunState, config *Config) {
+	if len(cmd) != 1 {
+		msg.Reply("Use *`approve <id>`* with the ID of the run awaiting approval.")
+		return
+	}
+
+	run, err := state.Pending(cmd[0])
+	if err == nil && run.Confirming {
+		err = errors.New("it hasn't been confirmed yet")
+	}
 	if err != nil {
+		msg.Reply(fmt.Sprintf("I couldn't approve `%s`: %s.", cmd[0], err))
+		return
+	}
+	if !checkApprover(msg, run, config) {
+		return
+	}
+
+	// Someone else may have got there first.
+	if run, err = state.Release(run.ID, false); err != nil {
+		msg.Reply(fmt.Sprintf("I couldn't approve `%s`: %s.", cmd[0], err))
+		return
+	}
+	if freeze := frozenRun(run, config); freeze != nil {
+		run.cancel()
+		dropFrozen(msg, run, freeze)
+		return
+	}
+	run.Approver, run.Approval, run.Approved = msg.ev.User, msg.ev.UserMention, time.Now()
+
+	reply := fmt.Sprintf("OK, I've approved `%s` (*%s %s* for %s).", run.ID, run.Stack, run.Playbook, run.Requester)
+	if pos := state.Enqueue(run); pos > 1 {
+		reply += fmt.Sprintf("  I'm busy running a playbook from *%s* so it's #%d in the queue.", run.Stack, pos)
+	}
+	msg.Reply(reply)
+	return
+}
+
+func processDeny(msg *Message, cmd []string, state *RunState, config *Config) {
+	if len(cmd) != 1 {
+		msg.Reply("Use *`deny <id>`* with the ID of the run awaiting approval.")
+		return
+	}
+
+	run, err := state.Pending(cmd[0])
+	if err == nil && run.Confirming {
+		err = errors.New("it hasn't been confirmed yet")
+	}
+	if err != nil {
+		msg.Reply(fmt.Sprintf("I couldn't deny `%s`: %s.", cmd[0], err))
+		return
+	}
+	// Requesters may withdraw their own runs.
+	if run.User != msg.ev.User && !checkApprover(msg, run, config) {
+		return
+	}
+
+	if run, err = state.UnparkIf(run.ID, false); err != nil {
+		msg.Reply(fmt.Sprintf("I couldn't deny `%s`: %s.", cmd[0], err))
+		return
+	}
+
+	msg.Reply(fmt.Sprintf("OK, I've dropped `%s` (*%s %s* for %s).", run.ID, run.Stack, run.Playbook, run.Requester))
+	return
+}
+
+// notifyRun reports the progress of run to the runs notification channel, if
+// there is one and it isn't where the run was requested.
+func notifyRun(msg *Message, run *Run, config *Config, status string) {
+	channel := config.Current().Notifications.Runs
+	if channel == "" || channel == run.Channel {
+		return
+	}
+
+	text := fmt.Sprintf("*%s %s*", run.Stack, run.Playbook)
+	if run.Action != "run" {
+		text += fmt.Sprintf(" (%s)", run.Action)
+	}
+	msg.chat.Post(channel, fmt.Sprintf("%s `%s` for %s %s.", text, run.ID, run.Requester, status))
+}
+
+// attachOutput uploads output from run to the run's thread, returning whether it
+// was attached.  parsed says whether it holds the JSON results.
+func attachOutput(msg *Message, run *Run, output []byte, parsed bool, config *Config) bool {
+	if config.Current().UploadOutput == "never" || len(output) == 0 {
+		return false
+	}
+
+	if err := uploadOutput(msg, run.ID, output, parsed); err != nil {
+		msg.Reply(fmt.Sprintf("I couldn't attach the output of `%s`: %s", run.ID, err))
+		return false
+	}
+	return true
+}
+
+// uploadOutput uploads output from the run identified by id to the thread of
+// msg.  parsed says whether it holds the JSON results.
+func uploadOutput(msg *Message, id string, output []byte, parsed bool) error {
+	filename, title := id+".log", fmt.Sprintf("The output of `%s`", id)
+	if parsed {
+		filename, title = id+".json", fmt.Sprintf("The results of `%s`", id)
+	}
+	return msg.Thread().Upload(filename, title, output)
+}
+
+// cancelButton returns a button that stops run.
+func cancelButton(run *Run) Button {
+	return Button{Text: "Cancel", Command: "cancel " + run.ID, Style: "danger", Once: true}
+}
+
+// replyFinished reports the outcome of the run recorded by rec, with buttons to
+// run it again or see its output.
+func replyFinished(msg *Message, rec *RunRecord) {
+	text := fmt.Sprintf("*%s %s*", rec.Stack, rec.Playbook)
+	if rec.Action != "run" {
+		text += fmt.Sprintf(" (%s)", rec.Action)
+	}
+	if rec.Plan {
+		text += " (plan)"
+	}
+	msg.ReplyButtons(fmt.Sprintf("%s `%s` %s.", text, rec.ID, rec.Outcome()),
+		Button{Text: "Re-run", Command: "rerun " + rec.ID},
+		Button{Text: "Show log", Command: "log " + rec.ID})
+}
+
+// tailOutput returns the end of output, no longer than n bytes.
+func tailOutput(output []byte, n int) string {
+	if len(output) <= n {
+		return string(output)
+	}
+	start := len(output) - n + len("...")
+	for start < len(output) && !utf8.RuneStart(output[start]) {
+		start++ // Don't split a character.
+	}
+	return "..." + string(output[start:])
+}
+
+// executePlaybook runs the playbook command args for run, reporting the
+// results to msg.
+func executePlaybook(msg *Message, run *Run, args []string, executor Executor, state *RunState, config *Config) {
+	defer state.Finish(run)
+	action, stack, playbook := run.Action, run.Stack, run.Playbook
+
+	var mention string
+	if run.Position > 1 || run.Approver != "" {
+		mention = run.Requester + " " // Let the user know their waiting run has started.
+	}
+	if action != "run" {
+		msg.ReplyButtons(fmt.Sprintf("%sOK, I'm running the %s action on the *%s %s* playbook...", mention, action, stack, playbook), cancelButton(run))
+	} else {
+		msg.ReplyButtons(fmt.Sprintf("%sOK, I'm running the *%s %s* playbook...", mention, stack, playbook), cancelButton(run))
+	}
+
+	env := []string{"ANSIBLE_STDOUT_CALLBACK=json", "ANSIBLE_RETRY_FILES_ENABLED=0"}
+
+	// Record the run as it starts so that it's in the history even if it
+	// never finishes.
+	record := NewRunRecord(run)
+	record.Digest = executor.Digest()
+	if err := state.History.Save(record); err != nil {
+		msg.Reply(fmt.Sprintf("I couldn't record run `%s` in my history: %s", run.ID, err))
+	}
+
+	notifyRun(msg, run, config, "has started")
+	defer func() {
+		notifyRun(msg, run, config, record.Outcome())
+		observeRun(record)
+		replyFinished(msg, record)
+	}()
+
+	// Stop the run if it takes too long.
+	if run.Timeout > 0 {
+		timer := time.AfterFunc(run.Timeout, func() {
+			run.Stop(fmt.Sprintf("timed out after %s", run.Timeout))
+		})
+		defer timer.Stop()
+	}
+
+	// Report progress in a thread on the run message.
+	reporter := NewProgressReporter(msg.Thread().NewStatus())
+	exit, output, err := executor.Run(run.Context(), run, args, env, reporter.Progress)
+	record.End, record.Exit, record.Output = time.Now(), exit, string(output)
+	if reason := run.Stopped(); reason != "" {
+		// Report what was done before the run was stopped.
+		record.Stopped, record.Results = reason, reporter.Results()
+		if err := state.History.Save(record); err != nil {
+			msg.Reply(fmt.Sprintf("I couldn't record run `%s` in my history: %s", run.ID, err))
+		}
+		reporter.Finish("was " + reason)
+		msg.Reply(describeStoppedRun(run, reason, record.Results))
+		return
+	} else if err != nil {
+		record.Error = err.Error()
+		reporter.Finish("could not be run")
 		msg.Reply(fmt.Sprintf("I'm sorry, *%s* failed on *%s %s*: %s", action, stack, playbook, err))
+	} else if exit != 0 {
+		reporter.Finish("failed")
+	} else {
+		reporter.Finish("succeeded")
 	}
 
 	var results *Results
-	if err = json.Unmarshal(output, &results); err != nil {
+	err = json.Unmarshal(output, &results)
+	record.Results = results
+	if err := state.History.Save(record); err != nil {
+		msg.Reply(fmt.Sprintf("I couldn't record run `%s` in my history: %s", run.ID, err))
+	}
+	if err != nil {
 		if exit == 0 {
 			msg.Send(fmt.Sprintf("Oh dear! I couldn't read the JSON returned by Ansible:```%s```", err))
+			attachOutput(msg, run, output, false, config)
 		} else {
-			reply := fmt.Sprintf("I'm sorry, *%s* failed on *%s %s*:\n>>>%s", action, stack, playbook, string(output))
+			reply := fmt.Sprintf("I'm sorry, *%s* failed on *%s %s*", action, stack, playbook)
+			if attachOutput(msg, run, output, false, config) {
+				reply += ": I've attached what Ansible said to the thread."
+			} else {
+				reply += ":\n>>>" + tailOutput(output, MaxMessageLength-len(reply)-5)
+			}
 			msg.Send(reply)
-			image := strings.Join([]string{config.Docker.Image, config.Docker.Tag}, ":")
-			cmd := fmt.Sprintf("docker pull %s && \\\ndocker run -t --rm %s %s", image, image, strings.Join(args, " "))
-			reply = fmt.Sprintf("You can replicate this problem from a terminal with:\n```%s```", cmd)
+			reply = fmt.Sprintf("You can replicate this problem from a terminal with:\n```%s```", executor.Replicate(args))
 			msg.Send(reply)
 		}
 		return
 	}
 
+	if exit != 0 || config.Current().UploadOutput == "always" {
+		attachOutput(msg, run, output, true, config)
+	}
+
 	if exit != 0 {
 		type FailedTask struct {
 			Name, Msg string
@@ -520,7 +1086,7 @@ func runPlaybook(msg *Message, action, stack, playbook string, client *docker.Cl
 					}
 					r += fmt.Sprintf("\n*%d. %s* returned this error:\n>%s", i+1, name, strings.Replace(task.Msg, "\n", "\n>", -1))
 				}
-				if (len(reply) + len(r) + 1) > slack.MaxMessageTextLength {
+				if (len(reply) + len(r) + 1) > MaxMessageLength {
 					if len(reply) > 0 {
 						msg.Reply(reply)
 					}
@@ -535,13 +1101,17 @@ func runPlaybook(msg *Message, action, stack, playbook string, client *docker.Cl
 		}
 
 		// For some reason Slack doesn't like these two messages concatenated, so send them separately.
-		image := strings.Join([]string{config.Docker.Image, config.Docker.Tag}, ":")
-		cmd := fmt.Sprintf("docker pull %s && \\\ndocker run -t --rm %s %s", image, image, strings.Join(args, " "))
-		msg.Reply(fmt.Sprintf("You can replicate this problem from a terminal with:\n```%s```", cmd))
+		msg.Reply(fmt.Sprintf("You can replicate this problem from a terminal with:\n```%s```", executor.Replicate(args)))
 	} else {
 		plays := results.GetStatsList()
 		reply := fmt.Sprintf("All *%s %s* tasks ran ok", stack, playbook)
-		if len(plays) > 1 {
+		if len(plays) == 0 {
+			reply = fmt.Sprintf("*%s %s* didn't run on any hosts", stack, playbook)
+			if run.Options != nil && run.Options.Limit != "" {
+				reply += fmt.Sprintf(": no hosts matched `--limit %s`", run.Options.Limit)
+			}
+			reply += "."
+		} else if len(plays) > 1 {
 			reply += fmt.Sprintf(" on the following %d hosts:", len(results.Stats))
 			for _, name := range plays {
 				stat := results.Stats[name]
@@ -566,22 +1136,91 @@ func runPlaybook(msg *Message, action, stack, playbook string, client *docker.Cl
 	return
 }
 
-func processRun(msg *Message, cmd []string, state *RunState, config *Config) {
-	client, err := getDockerClient()
+// describeStoppedRun summarises the results of a run that was stopped for
+// reason before it completed.
+func describeStoppedRun(run *Run, reason string, results *Results) (reply string) {
+	reply = fmt.Sprintf("I've stopped *%s %s* (`%s`): it was %s.", run.Stack, run.Playbook, run.ID, reason)
+	hosts := results.GetStatsList()
+	if len(hosts) == 0 {
+		reply += "  No tasks had completed."
+		return
+	}
+
+	reply += "  This is what had completed by then:"
+	for _, name := range hosts {
+		stat := results.Stats[name]
+		reply += fmt.Sprintf("\n  • *%s*: %d changed, %d ok, %d skipped, %d failed and %d unreachable.", name, stat.Changed, stat.Ok, stat.Skipped, stat.Failure, stat.Unreachable)
+	}
+	if n := len(results.Plays); n > 0 {
+		if play := results.Plays[n-1]; len(play.Tasks) > 0 {
+			reply += fmt.Sprintf("\nThe last task to start was *%s* in the *%s* play.", play.Tasks[len(play.Tasks)-1].Name, play.Name)
+		}
+	}
+	return
+}
+
+// mayStop returns whether the sender of msg may stop or drop run, replying if
+// they can't.  Like the API, this requires being allowed to run the playbook.
+func mayStop(msg *Message, run *Run, verb string, config *Config) bool {
+	who := identify(msg, config)
+	if who == nil {
+		return false
+	}
+	if !config.Access.Allows(who, run.Stack, run.Playbook, run.Action) {
+		msg.Reply(fmt.Sprintf("I'm sorry, only people who may run *%s %s* themselves can %s `%s`.", run.Stack, run.Playbook, verb, run.ID))
+		return false
+	}
+	return true
+}
+
+func processCancel(msg *Message, cmd []string, state *RunState, config *Config) {
+	if len(cmd) != 1 {
+		msg.Reply("Use *`cancel <stack>`* or *`cancel <id>`* to stop a running playbook.")
+		return
+	}
+
+	run, err := state.Running(cmd[0])
 	if err != nil {
-		msg.Reply(fmt.Sprintf("I could not create the Docker client: %s", err))
+		msg.Reply(fmt.Sprintf("I couldn't cancel `%s`: %s.", cmd[0], err))
+		return
+	}
+	if !mayStop(msg, run, "cancel", config) {
+		return
+	}
+
+	if !run.Stop(fmt.Sprintf("cancelled by %s", msg.ev.UserMention)) {
+		msg.Reply(fmt.Sprintf("I'm already stopping `%s`: it was %s.", run.ID, run.Stopped()))
 		return
 	}
 
-	if _, err = updateDevopsImage(msg, client, config); err != nil {
+	msg.Reply(fmt.Sprintf("OK, I'm stopping *%s %s* (`%s`)...", run.Stack, run.Playbook, run.ID))
+	return
+}
+
+func processRun(msg *Message, cmd []string, state *RunState, config *Config, logger *log.Logger) {
+	executors, err := NewExecutors(config)
+	if err != nil {
+		msg.Reply(fmt.Sprintf("I could not create the playbook executor: %s", err))
 		return
 	}
 
-	if len(config.Stacks) == 0 {
+	if len(config.Stacks()) == 0 {
 		msg.Reply("I'm sorry; there aren't any stacks listed.")
 		return
 	}
 
+	cmd, opts, err := ParseRunOptions(cmd)
+	if err != nil {
+		msg.Reply(fmt.Sprintf("I'm sorry, %s.", err))
+		return
+	}
+	cmd, params := ParseParams(cmd)
+
+	who := identify(msg, config)
+	if who == nil {
+		return
+	}
+
 	switch len(cmd) {
 	case 0:
 		fallthrough
@@ -589,10 +1228,10 @@ func processRun(msg *Message, cmd []string, state *RunState, config *Config) {
 		msg.Reply("I'm not sure what you mean. Try *`help`* instead.")
 	case 2: // <action> <stack>
 		action, stack := cmd[0], cmd[1]
-		runStack(msg, action, stack, state, config)
+		runStack(msg, who, action, stack, config)
 	case 3: // <action> <stack> <playbook>
 		action, stack, playbook := cmd[0], cmd[1], cmd[2]
-		runPlaybook(msg, action, stack, playbook, client, state, config)
+		runPlaybook(msg, who, action, stack, playbook, opts, params, false, executors, state, config, logger)
 	default: // Unhandled.
 		msg.Reply("That sounds way too complicated for a simpleton like me to understand! Try *`help`* instead.")
 	}
@@ -600,69 +1239,363 @@ func processRun(msg *Message, cmd []string, state *RunState, config *Config) {
 	return
 }
 
-func updateConfig(msg Conversation, client *docker.Client, config *Config) (err error) {
+func processPlan(msg *Message, cmd []string, state *RunState, config *Config, logger *log.Logger) {
+	cmd, opts, err := ParseRunOptions(cmd)
+	if err != nil {
+		msg.Reply(fmt.Sprintf("I'm sorry, %s.", err))
+		return
+	}
+	cmd, params := ParseParams(cmd)
+
+	var stack, playbook, action string
+	switch len(cmd) {
+	case 2:
+		stack, playbook, action = cmd[0], cmd[1], "run"
+	case 3:
+		stack, playbook, action = cmd[0], cmd[1], cmd[2]
+	default:
+		msg.Reply("Use *`plan <stack> <playbook>`* or *`plan <stack> <playbook> <action>`*.")
+		return
+	}
+
+	executors, err := NewExecutors(config)
+	if err != nil {
+		msg.Reply(fmt.Sprintf("I could not create the playbook executor: %s", err))
+		return
+	}
+
+	who := identify(msg, config)
+	if who == nil {
+		return
+	}
+
+	runPlaybook(msg, who, action, stack, playbook, opts, params, true, executors, state, config, logger)
+	return
+}
+
+func updateConfig(msg Conversation, executors Executors, config *Config) (err error) {
+	config.updating.Lock()
+	defer config.updating.Unlock()
+
 	var updated bool
-	if updated, err = updateDevopsImage(msg, client, config); err != nil {
+	if updated, err = updateDevopsImage(msg, executors, config); err != nil {
 		return
 	} else if !updated {
 		// Perform the initial configuration.
-		if err = updateConfigFromImage(msg, client, config); err != nil {
+		if err = updateConfigFromImage(msg, executors, config); err != nil {
 			return
 		}
-	} else {
-		if err = updateConfigFromImage(msg, client, config); err != nil {
+	}
+
+	return
+}
+
+func updateChannels(chat Chat, config *Config) error {
+	channels, err := chat.Channels()
+	if err != nil {
+		return err
+	}
+
+	config.Lock()
+	defer config.Unlock()
+	config.Channels = channels
+
+	return nil
+}
+
+func processConnectedEvent(chat Chat, config *Config) {
+	bc := NewBroadcast(chat, config.Channels)
+
+	executors, err := NewExecutors(config)
+	if err != nil {
+		bc.Send(fmt.Sprintf("I couldn't create the playbook executor: %s", err))
+		return
+	}
+
+	if updateConfig(bc, executors, config) == nil {
+		bc.Send("You rang...?")
+	}
+
+	return
+}
+
+func describeQueue(stack string, queue []*Run) (reply string) {
+	reply = fmt.Sprintf("*%s*:", stack)
+	for i, run := range queue {
+		var status string
+		if i == 0 {
+			status = "running"
+		} else {
+			status = fmt.Sprintf("#%d", i+1)
+		}
+		reply += fmt.Sprintf("\n  • `%s` %s: *%s %s*", run.ID, status, run.Stack, run.Playbook)
+		if run.Action != "run" {
+			reply += fmt.Sprintf(" (%s)", run.Action)
+		}
+		reply += fmt.Sprintf(" for %s", run.Requester)
+	}
+	return
+}
+
+func processQueue(msg *Message, cmd []string, state *RunState) {
+	var stacks []string
+	switch len(cmd) {
+	case 0:
+		if stacks = state.Stacks(); len(stacks) == 0 {
+			msg.Reply("I'm not running anything at the moment.")
 			return
 		}
+	case 1:
+		stacks = cmd
+	default:
+		msg.Reply("Use *`queue`* or *`queue <stack>`*.")
+		return
+	}
+
+	var replies []string
+	for _, stack := range stacks {
+		if queue := state.Queue(stack); len(queue) > 0 {
+			replies = append(replies, describeQueue(stack, queue))
+		} else {
+			replies = append(replies, fmt.Sprintf("Nothing is running or queued for *%s*.", stack))
+		}
 	}
 
+	msg.Reply(strings.Join(replies, "\n"))
 	return
 }
 
-func updateChannels(rtm *slack.RTM, config *Config) error {
-	channels := NewChannels()
+func processDequeue(msg *Message, cmd []string, state *RunState, config *Config) {
+	if len(cmd) != 1 {
+		msg.Reply("Use *`dequeue <id>`* with the ID I gave you when the run was queued.")
+		return
+	}
 
-	chans, err := rtm.GetChannels(true)
+	who := identify(msg, config)
+	if who == nil {
+		return
+	}
+
+	// Check access as the run is removed, as it may have left the queue or
+	// only just joined it.
+	run, err := state.DequeueIf(cmd[0], func(run *Run) error {
+		if !config.Access.Allows(who, run.Stack, run.Playbook, run.Action) {
+			return fmt.Errorf("only people who may run *%s %s* themselves can dequeue it", run.Stack, run.Playbook)
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		msg.Reply(fmt.Sprintf("I couldn't dequeue `%s`: %s.", cmd[0], err))
+		return
+	}
+
+	msg.Reply(fmt.Sprintf("OK, I've removed `%s` (*%s %s* for %s) from the queue.", run.ID, run.Stack, run.Playbook, run.Requester))
+	return
+}
+
+// historyLength is the number of runs listed by the history command.
+const historyLength = 10
+
+// timeFormat is used when reporting times to users.
+const timeFormat = "2006-01-02 15:04:05 MST"
+
+func processHistory(msg *Message, cmd []string, state *RunState, config *Config) {
+	var stack string
+	switch len(cmd) {
+	case 0:
+	case 1:
+		stack = cmd[0]
+	default:
+		msg.Reply("Use *`history`* or *`history <stack>`*.")
+		return
+	}
+
+	who := identify(msg, config)
+	if who == nil {
+		return
 	}
-	for _, c := range chans {
-		if c.IsMember {
-			channels.Names[c.ID] = Channel
+
+	// Only list the runs of playbooks the user may run.
+	recs, err := state.History.Recent(historyLength, func(rec *RunRecord) bool {
+		return (stack == "" || rec.Stack == stack) && config.Access.Allows(who, rec.Stack, rec.Playbook, rec.Action)
+	})
+	if err != nil {
+		msg.Reply(fmt.Sprintf("I'm sorry, I couldn't look up the runs: %s.", err))
+		return
+	} else if len(recs) == 0 && config.Access.Restricted() {
+		msg.Reply("I don't have a record of any runs you're allowed to see.")
+		return
+	} else if len(recs) == 0 {
+		msg.Reply("I don't have a record of any runs.")
+		return
+	}
+
+	var reply string
+	if stack == "" {
+		reply = fmt.Sprintf("These are the last %d runs:", len(recs))
+	} else {
+		reply = fmt.Sprintf("These are the last %d runs for *%s*:", len(recs), stack)
+	}
+	for _, rec := range recs {
+		reply += fmt.Sprintf("\n  • `%s` %s *%s %s*", rec.ID, rec.Start.Format(timeFormat), rec.Stack, rec.Playbook)
+		if rec.Action != "run" {
+			reply += fmt.Sprintf(" (%s)", rec.Action)
+		}
+		if rec.Plan {
+			reply += " (plan)"
 		}
+		reply += fmt.Sprintf(" by %s: %s", rec.Requester, rec.Outcome())
+	}
+
+	msg.Reply(reply)
+	return
+}
+
+func processShow(msg *Message, cmd []string, state *RunState, config *Config) {
+	if len(cmd) != 1 {
+		msg.Reply("Use *`show <id>`* with the ID of a run.")
+		return
 	}
 
-	groups, err := rtm.GetGroups(true)
+	rec, err := state.History.Get(cmd[0])
 	if err != nil {
-		return err
+		msg.Reply(fmt.Sprintf("I'm sorry, I couldn't look up `%s`: %s.", cmd[0], err))
+		return
 	}
-	for _, g := range groups {
-		channels.Names[g.ID] = Group
+
+	// The output may reveal more than those who can't run the playbook
+	// should see.
+	who := identify(msg, config)
+	if who == nil {
+		return
+	} else if !config.Access.Allows(who, rec.Stack, rec.Playbook, rec.Action) {
+		msg.Reply(fmt.Sprintf("I'm sorry, only people who may run *%s %s* themselves can see its runs.", rec.Stack, rec.Playbook))
+		return
 	}
 
-	config.Lock()
-	defer config.Unlock()
-	config.Channels = channels
+	reply := fmt.Sprintf("Run `%s` of *%s %s*", rec.ID, rec.Stack, rec.Playbook)
+	if rec.Action != "run" {
+		reply += fmt.Sprintf(" (%s)", rec.Action)
+	}
+	if rec.Plan {
+		reply += " in check mode"
+	}
+	reply += fmt.Sprintf(" %s.", rec.Outcome())
+	reply += fmt.Sprintf("\n  • Requested by %s in `%s`", rec.Requester, rec.Channel)
+	if !rec.Requested.IsZero() {
+		reply += fmt.Sprintf(" at %s", rec.Requested.Format(timeFormat))
+	}
+	reply += "."
+	if rec.Approver != "" {
+		reply += fmt.Sprintf("\n  • Approved by %s at %s.", rec.Approval, rec.Approved.Format(timeFormat))
+	}
+	if rec.Digest != "" {
+		reply += fmt.Sprintf("\n  • Ran from `%s`.", rec.Digest)
+	}
+	if len(rec.Vars) > 0 {
+		var vars []string
+		for k, v := range rec.Vars {
+			vars = append(vars, fmt.Sprintf("`%s=%s`", k, v))
+		}
+		sort.Strings(vars)
+		reply += fmt.Sprintf("\n  • Extra variables: %s.", strings.Join(vars, ", "))
+	}
+	if len(rec.Params) > 0 {
+		var params []string
+		for k, v := range rec.Params {
+			params = append(params, fmt.Sprintf("`%s=%s`", k, v))
+		}
+		sort.Strings(params)
+		reply += fmt.Sprintf("\n  • Parameters: %s.", strings.Join(params, ", "))
+	}
+	if rec.Options != nil && rec.Options.OverrideFreeze != "" {
+		reply += fmt.Sprintf("\n  • It overrode a freeze because %s.", Desentence(rec.Options.OverrideFreeze))
+	}
+	if rec.Options != nil && rec.Options.String() != "" {
+		reply += fmt.Sprintf("\n  • Options: `%s`.", rec.Options)
+	}
+	reply += fmt.Sprintf("\n  • Started at %s", rec.Start.Format(timeFormat))
+	if !rec.End.IsZero() {
+		reply += fmt.Sprintf(" and took %s with exit code %d.", rec.End.Sub(rec.Start), rec.Exit)
+	} else {
+		reply += "."
+	}
+	if rec.Error != "" {
+		reply += fmt.Sprintf("\n  • Failed with the error: %s", rec.Error)
+	}
+	if rec.Results != nil {
+		for _, name := range rec.Results.GetStatsList() {
+			stat := rec.Results.Stats[name]
+			reply += fmt.Sprintf("\n  • *%s*: %d changed, %d ok, %d skipped, %d failed and %d unreachable.", name, stat.Changed, stat.Ok, stat.Skipped, stat.Failure, stat.Unreachable)
+		}
+	}
+	msg.Reply(reply)
 
-	return nil
+	if rec.Output != "" {
+		output := tailOutput([]byte(rec.Output), MaxMessageLength-100)
+		msg.Reply(fmt.Sprintf("This is the output:\n```%s```", output))
+	}
+	return
 }
 
-func processConnectedEvent(rtm *slack.RTM, config *Config) {
-	bc := NewBroadcast(rtm, config.Channels)
+// processRerun runs a playbook again as it was run before.
+func processRerun(msg *Message, cmd []string, state *RunState, config *Config, logger *log.Logger) {
+	if len(cmd) != 1 {
+		msg.Reply("Use *`rerun <id>`* with the ID of the run to repeat.")
+		return
+	}
 
-	client, err := getDockerClient()
+	rec, err := state.History.Get(cmd[0])
 	if err != nil {
-		bc.Send(fmt.Sprintf("I couldn't create the Docker client: %s", err))
+		msg.Reply(fmt.Sprintf("I'm sorry, I couldn't look up `%s`: %s.", cmd[0], err))
 		return
 	}
 
-	if updateConfig(bc, client, config) == nil {
-		bc.Send("You rang...?")
+	executors, err := NewExecutors(config)
+	if err != nil {
+		msg.Reply(fmt.Sprintf("I could not create the playbook executor: %s", err))
+		return
+	}
+
+	who := identify(msg, config)
+	if who == nil {
+		return
+	}
+
+	// Freezes need overriding afresh.
+	opts := &RunOptions{}
+	if rec.Options != nil {
+		*opts = *rec.Options
+		opts.OverrideFreeze = ""
 	}
 
+	runPlaybook(msg, who, rec.Action, rec.Stack, rec.Playbook, opts, rec.Params, rec.Plan, executors, state, config, logger)
 	return
 }
 
-func processVersion(msg *Message) {
+// processLog attaches the output of a run.
+func processLog(msg *Message, cmd []string, state *RunState) {
+	if len(cmd) != 1 {
+		msg.Reply("Use *`log <id>`* with the ID of a run.")
+		return
+	}
+
+	rec, err := state.History.Get(cmd[0])
+	if err != nil {
+		msg.Reply(fmt.Sprintf("I'm sorry, I couldn't look up `%s`: %s.", cmd[0], err))
+		return
+	} else if rec.Output == "" {
+		msg.Reply(fmt.Sprintf("I don't have any output for `%s`.", rec.ID))
+		return
+	}
+
+	if err = uploadOutput(msg, rec.ID, []byte(rec.Output), rec.Results != nil); err != nil {
+		msg.Reply(fmt.Sprintf("I couldn't attach the output of `%s`: %s", rec.ID, err))
+	}
+	return
+}
+
+func processVersion(msg *Message, config *Config) {
 	var reply string
 	repo := "https://github.com/geo-data/lurch"
 	if version == "" || commit == "" {
@@ -671,18 +1604,30 @@ func processVersion(msg *Message) {
 		reply = fmt.Sprintf("I'm tagged as version <%s/releases/tag/%s|%s> built from commit <%s/commit/%s|%s>.", repo, version, version, repo, commit, commit)
 	}
 
+	if executors, err := NewExecutors(config); err == nil {
+		for _, name := range executors.Names() {
+			if digest := executors[name].Digest(); digest != "" {
+				reply += fmt.Sprintf("\nThe %s image is at `%s`", name, digest)
+				if config.Digests.Pinned(name) != "" {
+					reply += ", where it's pinned"
+				}
+				reply += "."
+			}
+		}
+	}
+
 	msg.Reply(reply)
 	return
 }
 
 func processMessage(
-	rtm *slack.RTM,
-	ev *slack.MessageEvent,
+	chat Chat,
+	ev *ChatMessageEvent,
 	user *User,
 	state *RunState,
 	config *Config,
 	logger *log.Logger) {
-	msg := NewMessage(rtm, ev, user)
+	msg := NewMessage(chat, ev, user)
 	if msg == nil {
 		return
 	}
@@ -693,8 +1638,17 @@ func processMessage(
 		return
 	}
 
-	// Process the command.
+	processCommand(msg, state, config, logger)
+}
+
+// processCommand carries out the command in msg, whether it was sent as a
+// message or by pressing a button.
+func processCommand(msg *Message, state *RunState, config *Config, logger *log.Logger) {
+	ev := msg.ev
 	cmd := msg.Command()
+	if len(cmd) == 0 {
+		return
+	}
 	//logger.Printf("Message for Lurch: %s\n", strings.Join(cmd, " "))
 	switch cmd[0] {
 	case "help":
@@ -704,13 +1658,93 @@ func processMessage(
 		processList(msg, cmd[1:], config)
 
 	case "version":
-		processVersion(msg)
+		processVersion(msg, config)
+
+	case "image":
+		processImage(msg, cmd[1:], config)
+
+	case "queue":
+		processQueue(msg, cmd[1:], state)
+
+	case "plan":
+		if config.AcceptsCommands(ev.Channel) {
+			processPlan(msg, cmd[1:], state, config, logger)
+		} else {
+			msg.Reply("I'm sorry, you can only plan playbooks on a group channel. This way everyone is notified.")
+		}
+
+	case "approve":
+		if config.AcceptsCommands(ev.Channel) {
+			processApprove(msg, cmd[1:], state, config)
+		} else {
+			msg.Reply("I'm sorry, you can only approve playbooks on a group channel. This way everyone is notified.")
+		}
+
+	case "deny":
+		if config.AcceptsCommands(ev.Channel) {
+			processDeny(msg, cmd[1:], state, config)
+		} else {
+			msg.Reply("I'm sorry, you can only deny playbooks on a group channel. This way everyone is notified.")
+		}
+
+	case "confirm":
+		processConfirm(msg, cmd[1:], state, config)
+
+	case "abort":
+		processAbort(msg, cmd[1:], state)
+
+	case "history":
+		processHistory(msg, cmd[1:], state, config)
+
+	case "log":
+		processLog(msg, cmd[1:], state)
+
+	case "rerun":
+		if config.AcceptsCommands(ev.Channel) {
+			processRerun(msg, cmd[1:], state, config, logger)
+		} else {
+			msg.Reply("I'm sorry, you can only rerun playbooks on a group channel. This way everyone is notified.")
+		}
+
+	case "show":
+		processShow(msg, cmd[1:], state, config)
+
+	case "freeze":
+		if len(cmd) == 1 || config.AcceptsCommands(ev.Channel) {
+			processFreeze(msg, cmd[1:], config)
+		} else {
+			msg.Reply("I'm sorry, you can only freeze stacks on a group channel. This way everyone is notified.")
+		}
+
+	case "unfreeze":
+		if config.AcceptsCommands(ev.Channel) {
+			processUnfreeze(msg, cmd[1:], config)
+		} else {
+			msg.Reply("I'm sorry, you can only unfreeze stacks on a group channel. This way everyone is notified.")
+		}
+
+	case "schedules":
+		processSchedules(msg, config)
+
+	case "dequeue":
+		if config.AcceptsCommands(ev.Channel) {
+			processDequeue(msg, cmd[1:], state, config)
+		} else {
+			msg.Reply("I'm sorry, you can only dequeue playbooks on a group channel. This way everyone is notified.")
+		}
+
+	case "cancel":
+		if config.AcceptsCommands(ev.Channel) {
+			processCancel(msg, cmd[1:], state, config)
+		} else {
+			msg.Reply("I'm sorry, you can only cancel playbooks on a group channel. This way everyone is notified.")
+		}
 
 	case "run":
 		fallthrough
 	default:
-		if config.EnableDM || config.Channels.HasChannel(ev.Channel) {
-			processRun(msg, cmd, state, config)
+		if config.AcceptsCommands(ev.Channel) {
+			processRun(msg, cmd, state, config, logger)
 		} else {
 			msg.Reply("I'm sorry, you can only run playbook commands on a group channel. This way everyone is notified.  This can be changed using my `--enable-dm` command line option.")
 		}
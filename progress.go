@@ -0,0 +1,320 @@
+package main
+
+// This provides live reporting of playbook progress.  Progress is obtained via
+// an Ansible callback plugin that Lurch installs alongside the playbooks: this
+// writes one line per event to stderr, which is picked out of the output and
+// summarised in a single status message that is edited in place.
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// progressPrefix identifies lines written by the callback plugin.
+	progressPrefix = "lurch-progress "
+
+	// progressInterval is the minimum time between status updates.
+	progressInterval = 2 * time.Second
+
+	// progressPluginName is the file name of the callback plugin.
+	progressPluginName = "lurch_progress.py"
+
+	// progressPluginDir is where the plugin is installed in the devops image.
+	// This is on Ansible's default callback plugin path.
+	progressPluginDir = "/usr/share/ansible/plugins/callback"
+)
+
+// progressPlugin is the source of the Ansible callback plugin.
+const progressPlugin = `from __future__ import absolute_import
+import json
+import sys
+
+from ansible.plugins.callback import CallbackBase
+
+
+class CallbackModule(CallbackBase):
+    """Reports playbook progress to Lurch, one event per line on stderr."""
+    CALLBACK_VERSION = 2.0
+    CALLBACK_TYPE = 'notification'
+    CALLBACK_NAME = 'lurch_progress'
+    CALLBACK_NEEDS_WHITELIST = False
+
+    def _emit(self, **event):
+        sys.stderr.write('` + progressPrefix + `' + json.dumps(event) + '\n')
+        sys.stderr.flush()
+
+    def _host(self, result, status):
+        msg = result._result.get('msg', '') if status in ('failed', 'unreachable') else ''
+        self._emit(event='host', host=result._host.get_name(), status=status, msg=msg)
+
+    def v2_playbook_on_play_start(self, play):
+        self._emit(event='play', name=play.get_name().strip())
+
+    def v2_playbook_on_task_start(self, task, is_conditional):
+        self._emit(event='task', name=task.get_name().strip())
+
+    def v2_playbook_on_handler_task_start(self, task):
+        self._emit(event='task', name=task.get_name().strip())
+
+    def v2_runner_on_ok(self, result):
+        self._host(result, 'changed' if result._result.get('changed') else 'ok')
+
+    def v2_runner_on_failed(self, result, ignore_errors=False):
+        self._host(result, 'ok' if ignore_errors else 'failed')
+
+    def v2_runner_on_unreachable(self, result):
+        self._host(result, 'unreachable')
+
+    def v2_runner_on_skipped(self, result):
+        self._host(result, 'skipped')
+`
+
+// progressPluginTar returns a tar archive containing the callback plugin
+// relative to the root directory.
+func progressPluginTar() (io.Reader, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    path.Join(progressPluginDir[1:], progressPluginName),
+		Mode:    0644,
+		Size:    int64(len(progressPlugin)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write([]byte(progressPlugin)); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
+
+// ProgressEvent is an event emitted by the callback plugin.
+type ProgressEvent struct {
+	Event  string `json:"event"` // One of play, task or host.
+	Name   string `json:"name,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Status string `json:"status,omitempty"` // The task status for a host.
+	Msg    string `json:"msg,omitempty"`    // Why a host failed.
+}
+
+// ProgressFunc is called for each ProgressEvent.
+type ProgressFunc func(*ProgressEvent)
+
+// progressWriter passes progress events to a ProgressFunc, writing all other
+// output to an underlying writer.
+type progressWriter struct {
+	w        io.Writer
+	progress ProgressFunc
+	line     []byte // Any incomplete line.
+}
+
+func newProgressWriter(w io.Writer, progress ProgressFunc) *progressWriter {
+	return &progressWriter{w: w, progress: progress}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.line = append(p.line, b...)
+	for {
+		i := bytes.IndexByte(p.line, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := p.line[:i+1]
+		if bytes.HasPrefix(line, []byte(progressPrefix)) {
+			var ev ProgressEvent
+			if err := json.Unmarshal(line[len(progressPrefix):], &ev); err == nil {
+				p.progress(&ev)
+			}
+		} else if _, err := p.w.Write(line); err != nil {
+			return 0, err
+		}
+		p.line = p.line[i+1:]
+	}
+
+	return len(b), nil
+}
+
+// Flush writes any incomplete line to the underlying writer.
+func (p *progressWriter) Flush() (err error) {
+	if len(p.line) > 0 {
+		_, err = p.w.Write(p.line)
+		p.line = nil
+	}
+	return
+}
+
+// lockedWriter serialises writes from multiple goroutines.
+type lockedWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (l *lockedWriter) Write(b []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.w.Write(b)
+}
+
+// ProgressReporter summarises progress events in a Status message.
+type ProgressReporter struct {
+	sync.Mutex
+	status       *Status
+	play, task   string
+	plays, tasks int
+	counts       map[string]int // Host results by status.
+	results      *Results       // The results of the tasks that have completed.
+	dirty        bool
+	stop         chan bool
+	stopped      sync.WaitGroup
+}
+
+func NewProgressReporter(status *Status) *ProgressReporter {
+	r := &ProgressReporter{
+		status:  status,
+		counts:  make(map[string]int),
+		results: &Results{Stats: make(map[string]*Stats)},
+		stop:    make(chan bool),
+	}
+	status.Set("Waiting for the playbook to start...")
+
+	r.stopped.Add(1)
+	go r.update()
+	return r
+}
+
+// Progress is a ProgressFunc recording ev.
+func (r *ProgressReporter) Progress(ev *ProgressEvent) {
+	r.Lock()
+	defer r.Unlock()
+
+	switch ev.Event {
+	case "play":
+		r.plays++
+		r.play, r.task = ev.Name, ""
+		r.results.Plays = append(r.results.Plays, &Play{Name: &Name{ev.Name}})
+	case "task":
+		r.tasks++
+		r.task = ev.Name
+		if n := len(r.results.Plays); n > 0 {
+			play := r.results.Plays[n-1]
+			play.Tasks = append(play.Tasks, &Task{Name: &Name{ev.Name}, Hosts: make(map[string]*Host)})
+		}
+	case "host":
+		r.counts[ev.Status]++
+		r.recordHost(ev)
+	default:
+		return
+	}
+	r.dirty = true
+}
+
+// recordHost adds the host result ev to the results.  The caller must hold the
+// lock.
+func (r *ProgressReporter) recordHost(ev *ProgressEvent) {
+	stats, ok := r.results.Stats[ev.Host]
+	if !ok {
+		stats = &Stats{}
+		r.results.Stats[ev.Host] = stats
+	}
+	switch ev.Status {
+	case "changed":
+		stats.Changed++
+		stats.Ok++
+	case "ok":
+		stats.Ok++
+	case "skipped":
+		stats.Skipped++
+	case "failed":
+		stats.Failure++
+	case "unreachable":
+		stats.Unreachable++
+	}
+
+	if n := len(r.results.Plays); n > 0 {
+		play := r.results.Plays[n-1]
+		if n = len(play.Tasks); n > 0 {
+			play.Tasks[n-1].Hosts[ev.Host] = &Host{
+				Failed:      ev.Status == "failed",
+				Unreachable: ev.Status == "unreachable",
+				Msg:         ev.Msg,
+			}
+		}
+	}
+}
+
+// Results returns the results of the tasks that have completed so far.
+func (r *ProgressReporter) Results() *Results {
+	r.Lock()
+	defer r.Unlock()
+	return r.results
+}
+
+// update periodically refreshes the status message until stopped.
+func (r *ProgressReporter) update() {
+	defer r.stopped.Done()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Don't hold the lock while posting, as that would block
+			// Progress if the chat server is slow.
+			r.Lock()
+			dirty, text := r.dirty, ""
+			if dirty {
+				text, r.dirty = r.text(), false
+			}
+			r.Unlock()
+			if dirty {
+				r.status.Set(text)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Finish stops updates and sets a final status describing the outcome e.g.
+// "succeeded".
+func (r *ProgressReporter) Finish(outcome string) {
+	close(r.stop)
+	r.stopped.Wait()
+
+	r.Lock()
+	text := fmt.Sprintf("The playbook %s.", outcome)
+	if r.plays > 0 {
+		text = fmt.Sprintf("The playbook %s after %d plays and %d tasks.\n%s", outcome, r.plays, r.tasks, r.totals())
+	}
+	r.Unlock()
+	r.status.Set(text)
+}
+
+// text describes the current progress.  The caller must hold the lock.
+func (r *ProgressReporter) text() (text string) {
+	if r.play != "" {
+		text += fmt.Sprintf("*Play %d:* %s\n", r.plays, r.play)
+	}
+	if r.task != "" {
+		text += fmt.Sprintf("*Task %d:* %s\n", r.tasks, r.task)
+	}
+	return text + r.totals()
+}
+
+// totals describes the host results.  The caller must hold the lock.
+func (r *ProgressReporter) totals() string {
+	return fmt.Sprintf("%d ok, %d changed, %d failed, %d unreachable and %d skipped.",
+		r.counts["ok"], r.counts["changed"], r.counts["failed"], r.counts["unreachable"], r.counts["skipped"])
+}
@@ -0,0 +1,168 @@
+package main
+
+// This provides a webhook for registries to announce pushed devops images, so
+// they're pulled straight away instead of when Lurch next polls.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	registryWebhookPath = "/registry/events"
+
+	// maxWebhookBody is the largest request body read from a registry.
+	maxWebhookBody = 1 << 20
+)
+
+// registryWebhook handles Docker Registry v2 notifications and Docker Hub
+// push webhooks.  Registries authenticate with the webhook secret, either as a
+// bearer token or, as Docker Hub can't set headers, in the token query
+// parameter.
+type registryWebhook struct {
+	chat   Chat
+	config *Config
+	logger *log.Logger
+}
+
+// imagePush is a tag pushed to a repository.
+type imagePush struct {
+	Repositories []string // The names the repository may be known by.
+	Tag          string
+}
+
+func (h *registryWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		apiError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(h.config.WebhookSecret)) != 1 {
+		apiError(w, http.StatusUnauthorized, errors.New("a valid token is required"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+	pushes, err := parseRegistryEvent(body)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	settings := h.config.Current()
+	names := pushedImages(pushes, settings.DockerImages())
+	if settings.Executor != "docker" || len(names) == 0 {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ignored"})
+		return
+	}
+
+	// Registries expect a prompt response, so pull the images afterwards.
+	h.logger.Printf("the registry announced a push of the %s images", strings.Join(names, ", "))
+	go func() {
+		if err := refreshImages(h.chat, names, h.config, h.logger); err != nil {
+			h.logger.Printf("couldn't refresh the pushed images: %s", err)
+		}
+	}()
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"status": "refreshing", "images": names})
+}
+
+// parseRegistryEvent returns the pushes described by a Docker Registry v2
+// notification or a Docker Hub webhook.
+func parseRegistryEvent(body []byte) (pushes []imagePush, err error) {
+	var event struct {
+		Events []struct {
+			Action string `json:"action"`
+			Target struct {
+				Repository string `json:"repository"`
+				Tag        string `json:"tag"`
+			} `json:"target"`
+			Request struct {
+				Host string `json:"host"`
+			} `json:"request"`
+		} `json:"events"`
+		PushData *struct {
+			Tag string `json:"tag"`
+		} `json:"push_data"`
+		Repository *struct {
+			RepoName string `json:"repo_name"`
+		} `json:"repository"`
+	}
+	if err = json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("the event isn't valid JSON: %s", err)
+	}
+
+	// Docker Hub.
+	if event.PushData != nil && event.Repository != nil {
+		pushes = append(pushes, imagePush{[]string{event.Repository.RepoName}, event.PushData.Tag})
+		return
+	}
+
+	// Docker Registry, which names the repository without the registry.  Pushes
+	// without a tag don't change any image Lurch uses.
+	for _, e := range event.Events {
+		if e.Action != "push" || e.Target.Tag == "" {
+			continue
+		}
+		repos := []string{e.Target.Repository}
+		if e.Request.Host != "" {
+			repos = append(repos, e.Request.Host+"/"+e.Target.Repository)
+		}
+		pushes = append(pushes, imagePush{repos, e.Target.Tag})
+	}
+	return
+}
+
+// pushedImages returns the names of the images that pushes changed, in order.
+func pushedImages(pushes []imagePush, images map[string]dockerConfig) (names []string) {
+	var all []string
+	for name := range images {
+		all = append(all, name)
+	}
+	sort.Strings(all)
+
+	for _, name := range all {
+		image := images[name]
+		tag := image.Tag
+		if tag == "" {
+			tag = "latest"
+		}
+	Pushes:
+		for _, push := range pushes {
+			if push.Tag != tag {
+				continue
+			}
+			for _, repo := range push.Repositories {
+				if normaliseRepository(repo) == normaliseRepository(image.Image) {
+					names = append(names, name)
+					break Pushes
+				}
+			}
+		}
+	}
+	return
+}
+
+// normaliseRepository returns the name of a repository on Docker Hub without
+// the registry or the library namespace of official images.
+func normaliseRepository(repo string) string {
+	for _, prefix := range []string{"docker.io/", "index.docker.io/", "registry-1.docker.io/"} {
+		repo = strings.TrimPrefix(repo, prefix)
+	}
+	return strings.TrimPrefix(repo, "library/")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	registryPush = `{"events": [
+		{"action": "pull", "target": {"repository": "geodata/devops", "tag": "latest"}, "request": {"host": "registry.example.com"}},
+		{"action": "push", "target": {"repository": "geodata/devops", "tag": "latest"}, "request": {"host": "registry.example.com"}}
+	]}`
+	hubPush = `{"push_data": {"tag": "stable"}, "repository": {"repo_name": "library/ansible"}}`
+)
+
+// newWebhookServer serves a registry webhook for the given images.
+func newWebhookServer(executor string, images map[string]dockerConfig) *httptest.Server {
+	config := &Config{WebhookSecret: "secret"}
+	config.Executor, config.Images = executor, images
+	return httptest.NewServer(&registryWebhook{
+		config: config,
+		logger: log.New(ioutil.Discard, "", 0),
+	})
+}
+
+// postEvent posts body to the webhook, returning the status code and the
+// decoded response.
+func postEvent(t *testing.T, url, token, body string) (int, map[string]interface{}) {
+	req, err := http.NewRequest("POST", url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var reply map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		t.Fatalf("the response isn't JSON: %s", err)
+	}
+	return resp.StatusCode, reply
+}
+
+func TestRegistryWebhookToken(t *testing.T) {
+	srv := newWebhookServer("docker", map[string]dockerConfig{"default": {Image: "ubuntu"}})
+	defer srv.Close()
+
+	tests := []struct {
+		url, token string
+		status     int
+	}{
+		{srv.URL, "", http.StatusUnauthorized},
+		{srv.URL, "wrong", http.StatusUnauthorized},
+		{srv.URL + "?token=wrong", "", http.StatusUnauthorized},
+		{srv.URL, "secret", http.StatusOK},
+		{srv.URL + "?token=secret", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		if status, _ := postEvent(t, test.url, test.token, hubPush); status != test.status {
+			t.Errorf("%s with token %q: expected %d, got %d", test.url, test.token, test.status, status)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestRegistryWebhookEvents(t *testing.T) {
+	images := map[string]dockerConfig{
+		"devops":  {Image: "registry.example.com/geodata/devops"},
+		"ansible": {Image: "docker.io/ansible", Tag: "stable"},
+		"other":   {Image: "geodata/other"},
+	}
+
+	tests := []struct {
+		name     string
+		executor string
+		body     string
+		status   int
+		images   []interface{}
+	}{
+		{"registry push", "docker", registryPush, http.StatusAccepted, []interface{}{"devops"}},
+		{"docker hub push", "docker", hubPush, http.StatusAccepted, []interface{}{"ansible"}},
+		{"another tag", "docker", strings.Replace(hubPush, "stable", "latest", 1), http.StatusOK, nil},
+		{"only pulls", "docker", strings.Replace(registryPush, `"push"`, `"pull"`, 1), http.StatusOK, nil},
+		{"no tag", "docker", `{"events": [{"action": "push", "target": {"repository": "geodata/devops"}}]}`, http.StatusOK, nil},
+		{"local executor", "local", registryPush, http.StatusOK, nil},
+		{"invalid JSON", "docker", "{", http.StatusBadRequest, nil},
+	}
+
+	for _, test := range tests {
+		srv := newWebhookServer(test.executor, images)
+		status, reply := postEvent(t, srv.URL, "secret", test.body)
+		srv.Close()
+
+		if status != test.status {
+			t.Errorf("%s: expected %d, got %d: %v", test.name, test.status, status, reply)
+			continue
+		}
+		if status == http.StatusOK && reply["status"] != "ignored" {
+			t.Errorf("%s: expected the event to be ignored, got %v", test.name, reply)
+		}
+		if test.images != nil && !reflect.DeepEqual(reply["images"], test.images) {
+			t.Errorf("%s: expected images %v, got %v", test.name, test.images, reply["images"])
+		}
+	}
+}
+
+func TestPushedImages(t *testing.T) {
+	images := map[string]dockerConfig{
+		"b": {Image: "geodata/devops"},
+		"a": {Image: "index.docker.io/geodata/devops", Tag: "latest"},
+		"c": {Image: "geodata/devops", Tag: "v2"},
+	}
+	pushes := []imagePush{{[]string{"docker.io/geodata/devops"}, "latest"}}
+	if names := pushedImages(pushes, images); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("expected a and b to be pushed, got %v", names)
+	}
+}
+
+func TestNormaliseRepository(t *testing.T) {
+	tests := map[string]string{
+		"ubuntu":                              "ubuntu",
+		"library/ubuntu":                      "ubuntu",
+		"docker.io/library/ubuntu":            "ubuntu",
+		"index.docker.io/geodata/devops":      "geodata/devops",
+		"registry-1.docker.io/geodata/devops": "geodata/devops",
+		"registry.example.com/geodata/devops": "registry.example.com/geodata/devops",
+		"registry.example.com/library/devops": "registry.example.com/library/devops",
+	}
+	for repo, expected := range tests {
+		if normalised := normaliseRepository(repo); normalised != expected {
+			t.Errorf("%s: expected %s, got %s", repo, expected, normalised)
+		}
+	}
+}
@@ -1,36 +1,293 @@
 package main
 
-import "sync"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
 
+	"golang.org/x/net/context"
+)
+
+// Run is a request to run a playbook.
+type Run struct {
+	sync.Mutex
+	ID         string
+	Stack      string
+	Playbook   string
+	Action     string
+	Plan       bool              // Whether this is a dry run in check mode.
+	Vars       map[string]string // Extra variables passed to the playbook.
+	Params     map[string]string // Parameters for the playbook, including defaults.
+	Options    *RunOptions       // Options targeting a subset of hosts or tasks.
+	Timeout    time.Duration     // How long the run may take, if non-zero.
+	User       string            // The ID of the user requesting the run.
+	Requester  string            // The mention string for the user requesting the run.
+	Channel    string            // The channel the run was requested from.
+	Queued     time.Time
+	Approvers  string     // The group that may approve the run, if not anyone.
+	Approver   string     // The ID of the user who approved the run, if it required approval.
+	Approval   string     // The mention string for the approving user.
+	Approved   time.Time  // When the run was approved.
+	Position   int        // The position in the queue when the run was queued.
+	Confirming bool       // Whether the run is waiting for the requester to confirm it.
+	start      func()     // Runs the playbook.
+	resume     func() int // Starts the run once it's confirmed, returning its position.
+	ctx        context.Context
+	cancel     context.CancelFunc
+	stopped    string // Why the run was stopped.
+}
+
+func NewRun(stack, playbook, action string, start func()) *Run {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Run{
+		ID:       newRunID(),
+		Stack:    stack,
+		Playbook: playbook,
+		Action:   action,
+		Queued:   time.Now(),
+		start:    start,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Context returns a context that is done when the run is stopped.
+func (r *Run) Context() context.Context {
+	return r.ctx
+}
+
+// Stop stops the run for the given reason, returning false if the run has
+// already been stopped.
+func (r *Run) Stop(reason string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.stopped != "" {
+		return false
+	}
+
+	r.stopped = reason
+	r.cancel()
+	return true
+}
+
+// Stopped returns why the run was stopped, or an empty string if it wasn't.
+func (r *Run) Stopped() string {
+	r.Lock()
+	defer r.Unlock()
+	return r.stopped
+}
+
+// newRunID returns a short random identifier for a run.
+func newRunID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		// Fall back to something that is still likely to be unique.
+		return fmt.Sprintf("%08x", uint32(time.Now().UnixNano()))
+	}
+	return hex.EncodeToString(b)
+}
+
+// RunState holds a FIFO queue of runs for each stack.  The run at the head of
+// a queue is the one currently running.  Runs awaiting approval are held
+// separately until they are queued.
 type RunState struct {
 	sync.Mutex
-	state map[string]bool
+	queues  map[string][]*Run
+	pending map[string]*Run // Runs awaiting approval keyed by ID.
+	History *History        // Where finished runs are recorded.
 }
 
-func NewRunState() (s *RunState) {
-	s = &RunState{}
-	s.state = make(map[string]bool)
+func NewRunState(history *History) (s *RunState) {
+	s = &RunState{History: history}
+	s.queues = make(map[string][]*Run)
+	s.pending = make(map[string]*Run)
 	return
 }
 
-func (s *RunState) Set(key string) bool {
+// Park holds run until it is approved.
+func (s *RunState) Park(run *Run) {
 	s.Lock()
 	defer s.Unlock()
-	if _, ok := s.state[key]; ok {
-		return false
+	s.pending[run.ID] = run
+}
+
+// Pending returns the run awaiting approval identified by id.
+func (s *RunState) Pending(id string) (*Run, error) {
+	s.Lock()
+	defer s.Unlock()
+	if run, ok := s.pending[id]; ok {
+		return run, nil
 	}
+	return nil, errors.New("there's no run awaiting approval with that ID")
+}
 
-	s.state[key] = true
-	return true
+// Unpark drops the run awaiting approval or confirmation identified by id,
+// returning it.
+func (s *RunState) Unpark(id string) (*Run, error) {
+	s.Lock()
+	defer s.Unlock()
+	run, ok := s.pending[id]
+	if !ok {
+		return nil, errors.New("there's no run awaiting approval with that ID")
+	}
+	delete(s.pending, id)
+	run.cancel() // Release the context's resources.
+	return run, nil
 }
 
-func (s *RunState) Unset(key string) bool {
+// UnparkIf drops the run identified by id if it's awaiting confirmation or
+// approval as given by confirming, returning it.
+func (s *RunState) UnparkIf(id string, confirming bool) (run *Run, err error) {
+	if run, err = s.Release(id, confirming); err == nil {
+		run.cancel() // Release the context's resources.
+	}
+	return
+}
+
+// Release removes the run identified by id if it's awaiting confirmation or
+// approval as given by confirming, returning it so that it can go ahead.
+func (s *RunState) Release(id string, confirming bool) (*Run, error) {
 	s.Lock()
 	defer s.Unlock()
-	if _, ok := s.state[key]; !ok {
-		return false
+	run, ok := s.pending[id]
+	if !ok || run.Confirming != confirming {
+		if confirming {
+			return nil, errors.New("there's no run awaiting confirmation with that ID")
+		}
+		return nil, errors.New("there's no run awaiting approval with that ID")
 	}
+	delete(s.pending, id)
+	return run, nil
+}
 
-	delete(s.state, key)
-	return true
+// Enqueue adds run to the queue for its stack, returning its position in the
+// queue.  The run is started immediately if it is at the head of the queue.
+func (s *RunState) Enqueue(run *Run) (position int) {
+	s.Lock()
+	defer s.Unlock()
+	s.queues[run.Stack] = append(s.queues[run.Stack], run)
+	position = len(s.queues[run.Stack])
+	run.Position = position
+
+	if position == 1 {
+		go run.start()
+	}
+	return
+}
+
+// Finish removes run from the head of its queue and starts the next run for
+// the stack, returning it.
+func (s *RunState) Finish(run *Run) (next *Run) {
+	s.Lock()
+	defer s.Unlock()
+	run.cancel() // Release the context's resources.
+	queue := s.queues[run.Stack]
+	if len(queue) == 0 || queue[0] != run {
+		return
+	}
+
+	if queue = queue[1:]; len(queue) == 0 {
+		delete(s.queues, run.Stack)
+		return
+	}
+
+	s.queues[run.Stack] = queue
+	next = queue[0]
+	go next.start()
+	return
+}
+
+// DequeueIf removes the waiting run identified by id unless check, which is
+// called with the lock held, returns an error for it.  Runs that have already
+// started can't be dequeued.
+func (s *RunState) DequeueIf(id string, check func(run *Run) error) (*Run, error) {
+	s.Lock()
+	defer s.Unlock()
+	for stack, queue := range s.queues {
+		for i, run := range queue {
+			if run.ID != id {
+				continue
+			}
+			if i == 0 {
+				return nil, errors.New("the run has already started")
+			}
+			if err := check(run); err != nil {
+				return nil, err
+			}
+			s.queues[stack] = append(queue[:i:i], queue[i+1:]...)
+			run.cancel() // Release the context's resources.
+			return run, nil
+		}
+	}
+
+	return nil, errors.New("there's no queued run with that ID")
+}
+
+// Running returns the running run identified by either its stack or its ID.
+func (s *RunState) Running(target string) (*Run, error) {
+	s.Lock()
+	defer s.Unlock()
+	if queue := s.queues[target]; len(queue) > 0 {
+		return queue[0], nil
+	}
+
+	for _, queue := range s.queues {
+		for i, run := range queue {
+			if run.ID != target {
+				continue
+			}
+			if i > 0 {
+				return nil, errors.New("the run hasn't started yet")
+			}
+			return run, nil
+		}
+	}
+
+	return nil, errors.New("there's nothing running with that stack or ID")
+}
+
+// Status returns the run identified by id if it is awaiting approval, queued
+// or running, along with which of these it is and its position in the queue.
+func (s *RunState) Status(id string) (run *Run, status string, position int) {
+	s.Lock()
+	defer s.Unlock()
+	if run, ok := s.pending[id]; ok {
+		return run, "pending", 0
+	}
+
+	for _, queue := range s.queues {
+		for i, run := range queue {
+			if run.ID != id {
+				continue
+			}
+			if i == 0 {
+				return run, "running", 1
+			}
+			return run, "queued", i + 1
+		}
+	}
+
+	return nil, "", 0
+}
+
+// Queue returns a copy of the queue for stack.
+func (s *RunState) Queue(stack string) []*Run {
+	s.Lock()
+	defer s.Unlock()
+	return append([]*Run(nil), s.queues[stack]...)
+}
+
+// Stacks returns the stacks with runs in progress.
+func (s *RunState) Stacks() (stacks []string) {
+	s.Lock()
+	defer s.Unlock()
+	for stack := range s.queues {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	return
 }
@@ -0,0 +1,188 @@
+package main
+
+// This provides runs that Lurch starts itself according to the schedules
+// declared in lurch.yml.
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// schedulePollInterval is how often schedules are checked for runs that are
+// due.
+const schedulePollInterval = 20 * time.Second
+
+// Schedule declares when a playbook or action is run automatically.
+type Schedule struct {
+	Cron     string `yaml:"cron"`               // A standard five field cron expression.
+	Timezone string `yaml:"timezone,omitempty"` // The time zone of the expression, UTC if not given.
+	Channel  string `yaml:"channel,omitempty"`  // The channel to report to, if not the runs notifications channel.
+}
+
+// Next returns the first time the schedule fires after t.
+func (s *Schedule) Next(t time.Time) (next time.Time, err error) {
+	loc := time.UTC
+	if s.Timezone != "" {
+		if loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return
+		}
+	}
+
+	var sched cron.Schedule
+	if sched, err = cron.ParseStandard(s.Cron); err != nil {
+		return
+	}
+	next = sched.Next(t.In(loc))
+	return
+}
+
+// ScheduledRun is a playbook or action with a schedule.
+type ScheduledRun struct {
+	Stack, Playbook, Action string
+	Schedule                *Schedule
+}
+
+// ScheduledRuns returns the scheduled runs in stacks, ordered by stack,
+// playbook and action.
+func ScheduledRuns(stacks map[string]Stack) (runs []ScheduledRun) {
+	var names []string
+	for stack := range stacks {
+		names = append(names, stack)
+	}
+	sort.Strings(names)
+
+	for _, stack := range names {
+		st := stacks[stack]
+		for _, playbook := range st.GetPlaybookList() {
+			pb := st.Playbooks[playbook]
+			if pb.Schedule != nil {
+				runs = append(runs, ScheduledRun{stack, playbook, "run", pb.Schedule})
+			}
+			for _, action := range pb.GetActionList() {
+				if a := pb.Actions[action]; a.Schedule != nil {
+					runs = append(runs, ScheduledRun{stack, playbook, action, a.Schedule})
+				}
+			}
+		}
+	}
+	return
+}
+
+// checkSchedules returns an error if any of the schedules in stacks is
+// invalid.
+func checkSchedules(stacks map[string]Stack) error {
+	for _, sr := range ScheduledRuns(stacks) {
+		if _, err := sr.Schedule.Next(time.Now()); err != nil {
+			return fmt.Errorf("the schedule for the %s action on *%s %s* is invalid: %s", sr.Action, sr.Stack, sr.Playbook, err)
+		}
+	}
+	return nil
+}
+
+// runScheduler starts scheduled runs as they fall due.
+func runScheduler(chat Chat, state *RunState, config *Config, logger *log.Logger) {
+	ticker := time.NewTicker(schedulePollInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for now := range ticker.C {
+		var due []ScheduledRun
+		for _, sr := range ScheduledRuns(config.Stacks()) {
+			if next, err := sr.Schedule.Next(last); err == nil && !next.After(now) {
+				due = append(due, sr)
+			}
+		}
+		last = now
+		if len(due) == 0 {
+			continue
+		}
+
+		executors, err := NewExecutors(config)
+		if err != nil {
+			logger.Printf("couldn't create the executor for scheduled runs: %s", err)
+			continue
+		}
+		for _, sr := range due {
+			startScheduledRun(chat, sr, executors, state, config, logger)
+		}
+	}
+}
+
+// startScheduledRun queues sr, announcing it in its channel.
+func startScheduledRun(chat Chat, sr ScheduledRun, executors Executors, state *RunState, config *Config, logger *log.Logger) {
+	channel := sr.Schedule.Channel
+	if channel == "" {
+		channel = config.Current().Notifications.Runs
+	}
+	if channel == "" {
+		logger.Printf("no channel to report the scheduled run of %s %s (%s) to", sr.Stack, sr.Playbook, sr.Action)
+		return
+	}
+
+	run, args, pb, err := prepareRun(nil, sr.Action, sr.Stack, sr.Playbook, &RunOptions{}, nil, false, config)
+	if err != nil {
+		chat.Post(channel, fmt.Sprintf("I couldn't start the scheduled run of *%s %s*: %s", sr.Stack, sr.Playbook, err))
+		return
+	}
+	executor, err := executors.For(sr.Stack, config)
+	if err != nil {
+		run.cancel()
+		chat.Post(channel, fmt.Sprintf("I couldn't start the scheduled run of *%s %s*: %s.", sr.Stack, sr.Playbook, err))
+		return
+	}
+
+	text := fmt.Sprintf("It's time for the scheduled run of *%s %s*", sr.Stack, sr.Playbook)
+	if sr.Action != "run" {
+		text += fmt.Sprintf(" (%s)", sr.Action)
+	}
+	thread, err := chat.PostThread(channel, "", text+fmt.Sprintf(", which is `%s`.", run.ID))
+	if err != nil {
+		run.cancel()
+		logger.Printf("couldn't announce the scheduled run of %s %s (%s): %s", sr.Stack, sr.Playbook, sr.Action, err)
+		return
+	}
+
+	msg := NewThreadMessage(chat, channel, thread, "schedule", "the schedule")
+	startRun(msg, run, args, pb, executor, state, config)
+}
+
+// processSchedules lists the scheduled runs with when they next start.
+func processSchedules(msg *Message, config *Config) {
+	who := identify(msg, config)
+	if who == nil {
+		return
+	}
+
+	var lines []string
+	for _, sr := range ScheduledRuns(config.Stacks()) {
+		if !config.Access.Allows(who, sr.Stack, sr.Playbook, sr.Action) {
+			continue
+		}
+
+		line := fmt.Sprintf("*%s %s*", sr.Stack, sr.Playbook)
+		if sr.Action != "run" {
+			line += fmt.Sprintf(" (%s)", sr.Action)
+		}
+		line += fmt.Sprintf(" `%s`", sr.Schedule.Cron)
+		if sr.Schedule.Timezone != "" {
+			line += " " + sr.Schedule.Timezone
+		}
+		if next, err := sr.Schedule.Next(time.Now()); err != nil {
+			line += fmt.Sprintf(": invalid (%s)", err)
+		} else {
+			line += fmt.Sprintf(": next at %s", next.Format("Mon 2 Jan 15:04 MST"))
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 {
+		msg.Reply("There aren't any scheduled runs.")
+		return
+	}
+	msg.Reply(fmt.Sprintf("These are the scheduled runs:\n  • %s", strings.Join(lines, "\n  • ")))
+}
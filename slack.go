@@ -1,11 +1,355 @@
 package main
 
-// This provides utilities for dealing with slack.
+// This provides the Slack implementation of the Chat interface.
 
-import "github.com/nlopes/slack"
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
-func BroadcastMessage(rtm *slack.RTM, msg string, channels []string) {
-	for _, id := range channels {
-		rtm.SendMessage(rtm.NewOutgoingMessage(msg, id))
+	"github.com/nlopes/slack"
+)
+
+// slackUploadURL is where files are uploaded.  The slack package can't upload
+// files to threads.
+const slackUploadURL = "https://slack.com/api/files.upload"
+
+// slackRequestMaxAge is how old an interaction request can be before it's
+// refused as a possible replay.
+const slackRequestMaxAge = 5 * time.Minute
+
+type SlackChat struct {
+	rtm     *slack.RTM
+	token   string
+	buttons bool // Whether button presses are received.
+	events  chan interface{}
+}
+
+func NewSlackChat(token string, buttons, debug bool, logger *log.Logger) *SlackChat {
+	api := slack.New(token)
+	slack.SetLogger(logger)
+	api.SetDebug(debug)
+
+	return &SlackChat{
+		rtm:     api.NewRTM(),
+		token:   token,
+		buttons: buttons,
+		events:  make(chan interface{}),
+	}
+}
+
+// Connect implements the Chat interface.
+func (s *SlackChat) Connect() {
+	go s.rtm.ManageConnection()
+	go s.translate()
+}
+
+// Events implements the Chat interface.
+func (s *SlackChat) Events() <-chan interface{} {
+	return s.events
+}
+
+// Post implements the Chat interface.
+func (s *SlackChat) Post(id, text string) (err error) {
+	params := slack.NewPostMessageParameters()
+	params.AsUser = true
+	_, _, err = s.rtm.PostMessage(id, text, params)
+	return
+}
+
+// PostThread implements the Chat interface.
+func (s *SlackChat) PostThread(id, thread, text string) (ts string, err error) {
+	params := slack.NewPostMessageParameters()
+	params.AsUser = true
+	params.ThreadTimestamp = thread
+	_, ts, err = s.rtm.PostMessage(id, text, params)
+	return
+}
+
+// Update implements the Chat interface.
+func (s *SlackChat) Update(id, msgID, text string) (err error) {
+	_, _, _, err = s.rtm.UpdateMessage(id, msgID, text)
+	return
+}
+
+// Upload implements the Chat interface.
+func (s *SlackChat) Upload(id, thread, filename, title string, content []byte) (err error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fields := map[string]string{
+		"token":     s.token,
+		"channels":  id,
+		"thread_ts": thread,
+		"filename":  filename,
+		"title":     title,
+	}
+	for name, value := range fields {
+		if err = w.WriteField(name, value); err != nil {
+			return
+		}
+	}
+	part, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		return
+	}
+	if _, err = part.Write(content); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+
+	resp, err := http.Post(slackUploadURL, w.FormDataContentType(), &body)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Ok    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return
+	} else if !result.Ok {
+		err = errors.New(result.Error)
+	}
+	return
+}
+
+// PostButtons implements the Chat interface.  The buttons are sent as the
+// actions of an attachment, with the command as their value.
+func (s *SlackChat) PostButtons(id, thread, text string, buttons []Button) (ts string, err error) {
+	if !s.buttons {
+		return s.PostThread(id, thread, ButtonCommands(text, buttons))
+	}
+
+	attachment := slack.Attachment{CallbackID: "lurch", Fallback: text}
+	for _, button := range buttons {
+		name := "command"
+		if button.Once {
+			name = "once"
+		}
+		attachment.Actions = append(attachment.Actions, slack.AttachmentAction{
+			Name:  name,
+			Text:  button.Text,
+			Style: button.Style,
+			Type:  "button",
+			Value: button.Command,
+		})
+	}
+
+	params := slack.NewPostMessageParameters()
+	params.AsUser = true
+	params.ThreadTimestamp = thread
+	params.Attachments = []slack.Attachment{attachment}
+	_, ts, err = s.rtm.PostMessage(id, text, params)
+	return
+}
+
+// Interactions implements the Interactive interface.  Requests are verified
+// using the app's signing secret, see
+// https://api.slack.com/docs/verifying-requests-from-slack.
+func (s *SlackChat) Interactions(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err = verifySlackRequest(r.Header, body, secret, time.Now()); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var callback slack.AttachmentActionCallback
+		if err = json.Unmarshal([]byte(r.PostFormValue("payload")), &callback); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if callback.CallbackID != "lurch" || len(callback.Actions) == 0 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		action := callback.Actions[0]
+		thread := callback.OriginalMessage.ThreadTimestamp
+		if thread == "" {
+			thread = callback.MessageTs
+		}
+		go func() {
+			s.events <- &ChatCommandEvent{ChatMessageEvent{
+				Channel:     callback.Channel.ID,
+				User:        callback.User.ID,
+				UserMention: fmt.Sprintf("<@%s>", callback.User.ID),
+				Text:        action.Value,
+				Thread:      thread,
+				Direct:      strings.HasPrefix(callback.Channel.ID, "D"),
+			}}
+		}()
+
+		if action.Name != "once" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		// Replace the buttons with who pressed which.
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"replace_original": true,
+			"text":             fmt.Sprintf("%s\n_<@%s> chose %s._", callback.OriginalMessage.Text, callback.User.ID, action.Text),
+		})
+	})
+}
+
+// verifySlackRequest returns an error unless the request with header and body
+// was signed by Slack using secret within the last few minutes.
+func verifySlackRequest(header http.Header, body []byte, secret string, now time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid request timestamp")
+	}
+	if age := now.Sub(time.Unix(secs, 0)); age > slackRequestMaxAge || age < -slackRequestMaxAge {
+		return errors.New("stale request")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return errors.New("invalid request signature")
+	}
+	return nil
+}
+
+// Channels implements the Chat interface.
+func (s *SlackChat) Channels() (*Channels, error) {
+	channels := NewChannels()
+
+	chans, err := s.rtm.GetChannels(true)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range chans {
+		if c.IsMember {
+			channels.Names[c.ID] = Channel
+		}
+	}
+
+	groups, err := s.rtm.GetGroups(true)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		channels.Names[g.ID] = Group
+	}
+
+	return channels, nil
+}
+
+// UserID implements the Chat interface.
+func (s *SlackChat) UserID(name string) (string, error) {
+	users, err := s.rtm.GetUsers()
+	if err != nil {
+		return "", err
+	}
+	for _, user := range users {
+		if user.Name == name {
+			return user.ID, nil
+		}
+	}
+	return "", nil
+}
+
+// GroupMembers implements the Chat interface.  Groups are Slack user groups,
+// identified by ID or handle.
+func (s *SlackChat) GroupMembers(group string) ([]string, error) {
+	groups, err := s.rtm.GetUserGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if g.ID == group || g.Handle == group {
+			return s.rtm.GetUserGroupMembers(g.ID)
+		}
+	}
+	return nil, fmt.Errorf("there's no user group called %s", group)
+}
+
+// translate converts Slack RTM events into chat events.
+func (s *SlackChat) translate() {
+	for msg := range s.rtm.IncomingEvents {
+		switch ev := msg.Data.(type) {
+		case *slack.ConnectedEvent:
+			user := ev.Info.User
+			s.events <- &ChatConnectedEvent{
+				User: NewUser(user.ID, user.Name, fmt.Sprintf("<@%s>", user.ID)),
+			}
+
+		case *slack.DisconnectedEvent:
+			s.events <- &ChatDisconnectedEvent{ev.Intentional}
+
+		case *slack.MessageEvent:
+			// Get the message text and thread.
+			var text, thread string
+			if ev.SubMessage != nil && ev.SubType == "message_changed" {
+				text, thread = ev.SubMessage.Text, ev.SubMessage.ThreadTimestamp
+				if thread == "" {
+					thread = ev.SubMessage.Timestamp
+				}
+			} else if ev.SubType == "" {
+				text, thread = ev.Text, ev.ThreadTimestamp
+				if thread == "" {
+					thread = ev.Timestamp
+				}
+			} else {
+				continue
+			}
+
+			s.events <- &ChatMessageEvent{
+				Channel:     ev.Channel,
+				User:        ev.User,
+				UserMention: fmt.Sprintf("<@%s>", ev.User),
+				Text:        text,
+				Thread:      thread,
+				Direct:      strings.HasPrefix(ev.Channel, "D"), // Slack IM channel IDs start with D.
+			}
+
+		case *slack.RTMError:
+			s.events <- &ChatErrorEvent{errors.New(ev.Error())}
+
+		case *slack.InvalidAuthEvent:
+			s.events <- &ChatInvalidAuthEvent{}
+
+		case *slack.GroupLeftEvent:
+			s.events <- &ChatLeftEvent{ev.Channel}
+		case *slack.ChannelLeftEvent:
+			s.events <- &ChatLeftEvent{ev.Channel}
+
+		case *slack.GroupJoinedEvent:
+			s.events <- &ChatJoinedEvent{ev.Channel.ID, Group}
+		case *slack.ChannelJoinedEvent:
+			s.events <- &ChatJoinedEvent{ev.Channel.ID, Channel}
+
+		default:
+			// Ignore other events...
+		}
 	}
 }
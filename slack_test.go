@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signSlackRequest returns the headers Slack sends with body at sent.
+func signSlackRequest(body, secret string, sent time.Time) http.Header {
+	timestamp := strconv.FormatInt(sent.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+
+	header := make(http.Header)
+	header.Set("X-Slack-Request-Timestamp", timestamp)
+	header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+	return header
+}
+
+func TestVerifySlackRequest(t *testing.T) {
+	const body = "payload=%7B%22type%22%3A%22interactive_message%22%7D"
+	now := time.Unix(1760000000, 0)
+	signed := signSlackRequest(body, "secret", now)
+
+	missing := signSlackRequest(body, "secret", now)
+	missing.Del("X-Slack-Request-Timestamp")
+	invalid := signSlackRequest(body, "secret", now)
+	invalid.Set("X-Slack-Request-Timestamp", "yesterday")
+	unsigned := signSlackRequest(body, "secret", now)
+	unsigned.Del("X-Slack-Signature")
+	resent := signSlackRequest(body, "secret", now.Add(-time.Hour))
+	resent.Set("X-Slack-Request-Timestamp", signed.Get("X-Slack-Request-Timestamp"))
+
+	tests := []struct {
+		name   string
+		header http.Header
+		body   string
+		valid  bool
+	}{
+		{"valid", signed, body, true},
+		{"a little old", signSlackRequest(body, "secret", now.Add(-slackRequestMaxAge+time.Second)), body, true},
+		{"clock skew", signSlackRequest(body, "secret", now.Add(slackRequestMaxAge-time.Second)), body, true},
+		{"wrong secret", signSlackRequest(body, "other", now), body, false},
+		{"tampered body", signed, body + "&x=1", false},
+		{"missing timestamp", missing, body, false},
+		{"invalid timestamp", invalid, body, false},
+		{"missing signature", unsigned, body, false},
+		{"stale", signSlackRequest(body, "secret", now.Add(-slackRequestMaxAge-time.Second)), body, false},
+		{"from the future", signSlackRequest(body, "secret", now.Add(slackRequestMaxAge+time.Second)), body, false},
+		{"replayed with a new timestamp", resent, body, false},
+	}
+
+	for _, test := range tests {
+		if err := verifySlackRequest(test.header, []byte(test.body), "secret", now); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid to be %t, got %v", test.name, test.valid, err)
+		}
+	}
+}
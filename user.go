@@ -1,21 +1,15 @@
 package main
 
-import (
-	"fmt"
-
-	"github.com/nlopes/slack"
-)
-
 type User struct {
 	Name,
 	Mention string // The string matching @ mentions for this user.
 	ID string
 }
 
-func NewUser(user *slack.UserDetails) *User {
+func NewUser(id, name, mention string) *User {
 	return &User{
-		Name:    user.Name,
-		Mention: fmt.Sprintf("<@%s>", user.ID),
-		ID:      user.ID,
+		Name:    name,
+		Mention: mention,
+		ID:      id,
 	}
 }